@@ -0,0 +1,140 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/xml"
+	"fmt"
+	"time"
+)
+
+// Atom feeds of the threads on the server and of the responses to each thread. Each
+// entry's ID is made from the thread's and the message's IDs, so that it stays the
+// same when the message is edited.
+
+const atom_media_type = "application/atom+xml"
+
+type atom_link struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atom_person struct {
+	Name string `xml:"name"`
+}
+
+type atom_entry struct {
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  atom_person `xml:"author"`
+	Links   []atom_link `xml:"link"`
+	Summary string      `xml:"summary,omitempty"`
+}
+
+type atom_feed struct {
+	XMLName xml.Name     `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string       `xml:"id"`
+	Title   string       `xml:"title"`
+	Updated string       `xml:"updated"`
+	Author  atom_person  `xml:"author"`
+	Links   []atom_link  `xml:"link"`
+	Entries []atom_entry `xml:"entry"`
+}
+
+// Converts a database timestamp to the form that Atom uses.
+func atom_timestamp(dt string) string {
+	t, err := time.Parse("2006-01-02 15:04:05Z", dt)
+	if err != nil {
+		return dt
+	}
+	return t.Format(time.RFC3339)
+}
+
+// Returns the entry for a message in a thread.
+func message_entry(item feed_item) atom_entry {
+
+	title := item.msg.title
+	if !item.is_origin {
+		title = "Re: " + item.thr.title + " — " + item.msg.title
+	}
+
+	return atom_entry{
+		ID:      fmt.Sprintf("%s/threads/%d#message-%d", server_url(), item.thr.id, item.msg.id),
+		Title:   title,
+		Updated: atom_timestamp(item.msg.dt_created),
+		Author:  atom_person{item.msg.author},
+		Links: []atom_link{
+			{Href: item.msg.url, Rel: "alternate"},
+			{Href: fmt.Sprintf("%s/threads/%d", server_url(), item.thr.id), Rel: "related"},
+		},
+		Summary: item.msg.summary,
+	}
+}
+
+func message_entries(items []feed_item) []atom_entry {
+	var entries []atom_entry
+	for _, item := range items {
+		entries = append(entries, message_entry(item))
+	}
+	return entries
+}
+
+func feed_xml(feed atom_feed) (string, error) {
+	out, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return xml.Header + string(out) + "\n", nil
+}
+
+// Returns the feed of new threads and the latest responses to them.
+func threads_feed(db *sql.DB) (string, error) {
+
+	items, err := recent_feed_items(db)
+	if err != nil {
+		return "", err
+	}
+
+	feed := atom_feed{
+		ID:      server_url() + "/threads/feed.atom",
+		Title:   "GemThread threads",
+		Updated: atom_timestamp(now_timestamp()),
+		Author:  atom_person{"GemThread"},
+		Links: []atom_link{
+			{Href: server_url() + "/threads/feed.atom", Rel: "self", Type: atom_media_type},
+			{Href: server_url() + "/threads", Rel: "alternate"},
+		},
+		Entries: message_entries(items),
+	}
+	if len(items) > 0 {
+		feed.Updated = atom_timestamp(items[0].msg.dt_created)
+	}
+
+	return feed_xml(feed)
+}
+
+// Returns the feed of responses to a thread.
+func thread_feed(db *sql.DB, thr GemThreadThread) (string, error) {
+
+	items, err := thread_feed_items(db, thr, false)
+	if err != nil {
+		return "", err
+	}
+
+	thr_url := fmt.Sprintf("%s/threads/%d", server_url(), thr.id)
+
+	feed := atom_feed{
+		ID:      thr_url + "/feed.atom",
+		Title:   thr.author + " — " + thr.title,
+		Updated: atom_timestamp(thread_updated(thr)),
+		Author:  atom_person{thr.author},
+		Links: []atom_link{
+			{Href: thr_url + "/feed.atom", Rel: "self", Type: atom_media_type},
+			{Href: thr_url, Rel: "alternate"},
+		},
+		Entries: message_entries(items),
+	}
+
+	return feed_xml(feed)
+}
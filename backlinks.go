@@ -0,0 +1,100 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// A thread can require that its responses link back to it: a response is then only
+// accepted if its page has a link line to the page that started the thread, or to the
+// thread on this server. The moderation require_backlinks setting requires this of
+// every thread, and the author of a thread can require it of their own thread by
+// adding "GemThread.RequireBacklinks" to the page that started it. A thread's own
+// setting is kept in the thread_policies table, and is updated whenever the page that
+// started the thread is fetched again.
+
+// Records whether the thread that msg started requires backlinks, if it started one.
+func save_thread_policy(db *sql.DB, msg GemThreadMessage) error {
+
+	thr, err := db_find_thread_by_originating_message_id(db, msg.id)
+	if err != nil || thr.id == 0 {
+		return err
+	}
+
+	return db_save_thread_policy(db, thr.id, msg.require_backlinks)
+}
+
+func thread_requires_backlinks(db *sql.DB, thr_id int64) (bool, error) {
+	if config().Moderation.RequireBacklinks {
+		return true, nil
+	}
+	return db_find_thread_policy(db, thr_id)
+}
+
+// Returns link in a form that can be compared with other links to the same page: the
+// scheme and host are lower case, the default port and the fragment are dropped, and
+// the path has no dot segments or trailing slash.
+func normalize_link(link string) string {
+
+	u, err := url.Parse(link)
+	if err != nil || !u.IsAbs() {
+		return link
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	if u.Scheme == "gemini" {
+		u.Host = strings.TrimSuffix(u.Host, ":1965")
+	}
+	u.Fragment = ""
+	u.RawFragment = ""
+
+	if len(u.Path) > 0 {
+		u.Path = strings.TrimSuffix(path.Clean(u.Path), "/")
+	}
+	u.RawPath = ""
+
+	return u.String()
+}
+
+// Returns a rejected_error saying which link is missing if the thread requires
+// backlinks and none of links is one. media_type is that of the page the links are
+// from.
+func check_backlink(db *sql.DB, thr_id int64, media_type string, links []string) error {
+
+	required, err := thread_requires_backlinks(db, thr_id)
+	if err != nil || !required {
+		return err
+	}
+
+	origin, err := db_find_originating_message_for_thread(db, thr_id)
+	if err != nil {
+		return err
+	}
+
+	thr_url := fmt.Sprintf("%s/threads/%d", server_url(), thr_id)
+
+	for _, link := range links {
+		link = normalize_link(link)
+		if link == normalize_link(thr_url) || local_link_id(link, "threads") == thr_id {
+			return nil
+		}
+		if origin.id > 0 && link == normalize_link(origin.url) {
+			return nil
+		}
+	}
+
+	// Only gemtext pages have link lines
+	if media_type != "text/gemini" {
+		return rejected_error{fmt.Sprintf("MISSING BACKLINK: thread %d only accepts responses that link to it, but your page is %s, which has no link lines; respond with a text/gemini page instead", thr_id, media_type)}
+	}
+
+	if origin.id == 0 {
+		return rejected_error{fmt.Sprintf("MISSING BACKLINK: thread %d only accepts responses that link to it; add the link line \"=> %s\" to your page and submit it again", thr_id, thr_url)}
+	}
+
+	return rejected_error{fmt.Sprintf("MISSING BACKLINK: thread %d only accepts responses that link to the post that started it; add the link line \"=> %s\" or \"=> %s\" to your page and submit it again", thr_id, origin.url, thr_url)}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeLink(t *testing.T) {
+
+	tests := []struct {
+		link string
+		want string
+	}{
+		{"gemini://example.org/post.gmi", "gemini://example.org/post.gmi"},
+		{"GEMINI://Example.ORG/post.gmi", "gemini://example.org/post.gmi"},
+		{"gemini://example.org:1965/post.gmi", "gemini://example.org/post.gmi"},
+		{"gemini://example.org:1966/post.gmi", "gemini://example.org:1966/post.gmi"},
+		{"https://example.org:1965/post.gmi", "https://example.org:1965/post.gmi"},
+		{"gemini://example.org", "gemini://example.org"},
+		{"gemini://example.org/", "gemini://example.org"},
+		{"gemini://example.org/log/", "gemini://example.org/log"},
+		{"gemini://example.org/log/./2021/../post.gmi", "gemini://example.org/log/post.gmi"},
+		{"gemini://example.org/post.gmi#reply", "gemini://example.org/post.gmi"},
+		{"gemini://example.org/log/?page=2", "gemini://example.org/log?page=2"},
+		{"post.gmi", "post.gmi"},
+	}
+
+	for _, test := range tests {
+		got := normalize_link(test.link)
+		if got != test.want {
+			t.Errorf("normalize_link(%q): got %q, want %q", test.link, got, test.want)
+		}
+	}
+}
+
+func TestCheckBacklink(t *testing.T) {
+
+	cfg := default_config()
+	cfg.ServerURL = "gemini://gemthread.example/gemthread"
+	set_config(cfg, nil)
+
+	db, err := db_open(filepath.Join(t.TempDir(), "gemthread.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	thr_id, err := db_create_new_thread(db, GemThreadMessage{url: "gemini://a.example/log/post.gmi", author: "a", title: "post"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db_save_thread_policy(db, thr_id, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		media_type string
+		links      []string
+		// The rejection contains this, or there is no rejection if it is empty
+		want string
+	}{
+		{"the thread", "text/gemini", []string{fmt.Sprintf("gemini://gemthread.example/gemthread/threads/%d", thr_id)}, ""},
+		{"the thread with a trailing slash", "text/gemini", []string{fmt.Sprintf("gemini://gemthread.example/gemthread/threads/%d/", thr_id)}, ""},
+		{"the thread with the default port", "text/gemini", []string{fmt.Sprintf("gemini://GemThread.example:1965/gemthread/threads/%d", thr_id)}, ""},
+		{"the post", "text/gemini", []string{"gemini://a.example/log/post.gmi"}, ""},
+		{"the post with a different case host and a fragment", "text/gemini", []string{"gemini://A.Example/log/post.gmi#top"}, ""},
+		{"the post through dot segments", "text/gemini", []string{"gemini://a.example:1965/log/../log/./post.gmi"}, ""},
+		{"another thread", "text/gemini", []string{fmt.Sprintf("gemini://gemthread.example/gemthread/threads/%d", thr_id+1)}, "MISSING BACKLINK"},
+		{"another page", "text/gemini", []string{"gemini://a.example/log/other.gmi"}, "MISSING BACKLINK"},
+		{"no links", "text/gemini", nil, "=> gemini://a.example/log/post.gmi"},
+		{"a page with no link lines", "text/markdown", nil, "text/markdown"},
+	}
+
+	for _, test := range tests {
+		err := check_backlink(db, thr_id, test.media_type, test.links)
+		if len(test.want) == 0 {
+			if err != nil {
+				t.Errorf("%s: got %q, want no error", test.name, err.Error())
+			}
+			continue
+		}
+		var rejected rejected_error
+		if !errors.As(err, &rejected) {
+			t.Errorf("%s: got %v, want a rejected_error", test.name, err)
+		} else if !strings.Contains(rejected.message, test.want) {
+			t.Errorf("%s: got %q, want it to contain %q", test.name, rejected.message, test.want)
+		}
+	}
+}
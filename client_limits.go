@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Limits on how many submissions each client may make. A client is identified by the
+// fingerprint of its certificate (TLS_CLIENT_HASH) when it presents one, and by its
+// address (REMOTE_ADDR) otherwise. Each kind of submission is counted separately over
+// a sliding window.
+
+type submission_kind string
+
+const (
+	submission_thread   submission_kind = "thread"
+	submission_response submission_kind = "response"
+	submission_refetch  submission_kind = "refetch"
+	// A response submitted to /respond, which counts against the responses limit
+	submission_auto_response submission_kind = "auto_response"
+)
+
+// The number of submissions of a kind that a client may make in each window.
+// Zero means no limit.
+func submission_limit(kind submission_kind) int {
+	switch kind {
+	case submission_thread:
+		return config().Limits.NewThreads
+	case submission_response:
+		return config().Limits.Responses
+	case submission_refetch:
+		return config().Limits.Refetches
+	}
+	return 0
+}
+
+var _client_submissions = make(map[string][]time.Time)
+var _client_submissions_lock sync.Mutex
+
+// Identifies the client that made a request, or returns "" if the transport did not
+// say who it was.
+func client_id(req gemthread_request) string {
+	if hash := req.params["TLS_CLIENT_HASH"]; len(hash) > 0 {
+		return "cert:" + hash
+	}
+	if addr := req.params["REMOTE_ADDR"]; len(addr) > 0 {
+		return "addr:" + addr
+	}
+	return ""
+}
+
+// Records a submission by client, or returns a slow_down_error saying how long the
+// client must wait if it has reached its limit.
+func reserve_submission(client string, kind submission_kind) error {
+
+	limit := submission_limit(kind)
+	if limit <= 0 || len(client) == 0 {
+		return nil
+	}
+
+	window := config().Limits.Window.Duration
+	key := string(kind) + " " + client
+	now := time.Now()
+
+	_client_submissions_lock.Lock()
+	defer _client_submissions_lock.Unlock()
+
+	if len(_client_submissions) >= host_limits_prune_size {
+		for k, v := range _client_submissions {
+			if now.Sub(v[len(v)-1]) > window {
+				delete(_client_submissions, k)
+			}
+		}
+	}
+
+	// Forget submissions that have left the window
+	recent := _client_submissions[key]
+	for len(recent) > 0 && now.Sub(recent[0]) > window {
+		recent = recent[1:]
+	}
+
+	if len(recent) >= limit {
+		_client_submissions[key] = recent
+		return slow_down_error{
+			reason: fmt.Sprintf("at most %d %s submissions may be made every %s", limit, kind, window),
+			wait:   recent[0].Add(window).Sub(now),
+		}
+	}
+
+	_client_submissions[key] = append(recent, now)
+
+	return nil
+}
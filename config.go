@@ -0,0 +1,592 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// GemThreadConfig is the contents of the gemthread configuration file. Fields are
+// exported only so that the TOML decoder can set them.
+type GemThreadConfig struct {
+	// Full URL to the gemthread instance, without a trailing slash
+	ServerURL string `toml:"server_url"`
+
+	Listener   GemThreadListenerConfig   `toml:"listener"`
+	Database   GemThreadDatabaseConfig   `toml:"database"`
+	Fetcher    GemThreadFetcherConfig    `toml:"fetcher"`
+	Moderation GemThreadModerationConfig `toml:"moderation"`
+	Limits     GemThreadLimitsConfig     `toml:"limits"`
+	Queue      GemThreadQueueConfig      `toml:"queue"`
+	Refresh    GemThreadRefreshConfig    `toml:"refresh"`
+	Snapshots  GemThreadSnapshotsConfig  `toml:"snapshots"`
+	Templates  GemThreadTemplatesConfig  `toml:"templates"`
+}
+
+type GemThreadListenerConfig struct {
+	Mode            string `toml:"mode"`
+	SocketPath      string `toml:"socket_path"`
+	Address         string `toml:"address"`
+	CertificatePath string `toml:"certificate_path"`
+	KeyPath         string `toml:"key_path"`
+	// How long to wait for in-flight requests to finish when shutting down
+	ShutdownTimeout config_duration `toml:"shutdown_timeout"`
+}
+
+type GemThreadDatabaseConfig struct {
+	Path string `toml:"path"`
+}
+
+type GemThreadFetcherConfig struct {
+	MaxRedirects int `toml:"max_redirects"`
+	// Time allowed to establish a connection to the remote host
+	ConnectTimeout config_duration `toml:"connect_timeout"`
+	// Time allowed, per redirect, to receive the response header
+	HeaderTimeout config_duration `toml:"header_timeout"`
+	// Time allowed to receive the response body
+	BodyTimeout config_duration `toml:"body_timeout"`
+	// Largest response body, in bytes, that will be read
+	MaxBodySize int64 `toml:"max_body_size"`
+	// Whether larger bodies are truncated (true) or rejected (false)
+	TruncateLargeBodies bool `toml:"truncate_large_bodies"`
+	// What to do when a host's certificate changes: "reject", "flag" or "off"
+	TofuPolicy string `toml:"tofu_policy"`
+	// Networks, in CIDR notation, that may not be fetched from in addition to the
+	// loopback, link-local and private networks that are always blocked
+	BlockedNetworks []string `toml:"blocked_networks"`
+	// Networks that may be fetched from even though they are blocked
+	AllowedNetworks []string `toml:"allowed_networks"`
+	// Whether robots.txt is consulted before fetching a page
+	ObeyRobots bool `toml:"obey_robots"`
+	// Virtual agent names whose robots.txt rules apply, in addition to "*"
+	RobotsUserAgents []string `toml:"robots_user_agents"`
+	// How long a host's robots.txt is cached
+	RobotsCacheTime config_duration `toml:"robots_cache_time"`
+	// Sustained rate of fetches allowed from any one host; zero disables the limit
+	HostFetchesPerMinute int `toml:"host_fetches_per_minute"`
+	// Fetches from one host that may be made in quick succession
+	HostBurst int `toml:"host_burst"`
+	// Least time between two fetches from the same host
+	MinHostInterval config_duration `toml:"min_host_interval"`
+	// How long a fetched page is reused instead of being fetched again
+	RefetchCooldown config_duration `toml:"refetch_cooldown"`
+}
+
+type GemThreadModerationConfig struct {
+	// Hosts whose pages may not be added as threads or responses
+	BlockedHosts []string `toml:"blocked_hosts"`
+	// Whether every response must link to the thread it is added to
+	RequireBacklinks bool `toml:"require_backlinks"`
+}
+
+// Limits on submissions by each client; zero means no limit
+type GemThreadLimitsConfig struct {
+	// Period over which each client's submissions are counted
+	Window     config_duration `toml:"window"`
+	NewThreads int             `toml:"new_threads"`
+	Responses  int             `toml:"responses"`
+	Refetches  int             `toml:"refetches"`
+}
+
+type GemThreadQueueConfig struct {
+	// Number of submissions that are fetched at the same time
+	Workers int `toml:"workers"`
+	// Attempts made to fetch a submission before it is marked as failed
+	MaxAttempts int `toml:"max_attempts"`
+	// Delay before a failed fetch is retried, doubling after each failure
+	RetryDelay    config_duration `toml:"retry_delay"`
+	MaxRetryDelay config_duration `toml:"max_retry_delay"`
+}
+
+type GemThreadRefreshConfig struct {
+	// Whether every message is periodically fetched again to pick up changes
+	Enabled bool `toml:"enabled"`
+	// How often each message is fetched again
+	Interval config_duration `toml:"interval"`
+	// Greatest random amount by which each message's interval is lengthened or shortened
+	Jitter config_duration `toml:"jitter"`
+	// Checks in a row that must find a page not found, or its server unreachable,
+	// before its message is marked as unreachable
+	UnreachableAfter int `toml:"unreachable_after"`
+}
+
+type GemThreadSnapshotsConfig struct {
+	// Whether a copy of each page is kept, to be shown if the page disappears
+	Enabled bool `toml:"enabled"`
+}
+
+type GemThreadTemplatesConfig struct {
+	HelpPath string `toml:"help_path"`
+}
+
+// config_duration is a time.Duration written as a string, such as "30s" or "5m", in
+// the configuration file.
+type config_duration struct {
+	time.Duration
+}
+
+func (d *config_duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+func default_config() GemThreadConfig {
+	return GemThreadConfig{
+		ServerURL: "",
+		Listener: GemThreadListenerConfig{
+			Mode:            "scgi",
+			SocketPath:      "gemthread.sock",
+			Address:         ":1965",
+			CertificatePath: "gemthread.crt",
+			KeyPath:         "gemthread.key",
+			ShutdownTimeout: config_duration{30 * time.Second},
+		},
+		Database: GemThreadDatabaseConfig{
+			Path: "gemthread.db",
+		},
+		Fetcher: GemThreadFetcherConfig{
+			MaxRedirects:         5,
+			ConnectTimeout:       config_duration{10 * time.Second},
+			HeaderTimeout:        config_duration{30 * time.Second},
+			BodyTimeout:          config_duration{60 * time.Second},
+			MaxBodySize:          1024 * 1024,
+			TruncateLargeBodies:  true,
+			TofuPolicy:           "reject",
+			ObeyRobots:           true,
+			RobotsUserAgents:     []string{"gemthread", "indexer"},
+			RobotsCacheTime:      config_duration{time.Hour},
+			HostFetchesPerMinute: 10,
+			HostBurst:            5,
+			MinHostInterval:      config_duration{time.Second},
+			RefetchCooldown:      config_duration{5 * time.Minute},
+		},
+		Limits: GemThreadLimitsConfig{
+			Window:     config_duration{time.Hour},
+			NewThreads: 5,
+			Responses:  20,
+			Refetches:  20,
+		},
+		Queue: GemThreadQueueConfig{
+			Workers:       2,
+			MaxAttempts:   5,
+			RetryDelay:    config_duration{time.Minute},
+			MaxRetryDelay: config_duration{time.Hour},
+		},
+		Refresh: GemThreadRefreshConfig{
+			Enabled:          true,
+			Interval:         config_duration{24 * time.Hour},
+			Jitter:           config_duration{2 * time.Hour},
+			UnreachableAfter: 3,
+		},
+		Templates: GemThreadTemplatesConfig{
+			HelpPath: "help.gmi",
+		},
+	}
+}
+
+// The running configuration and help template. Both are replaced as a unit when the
+// configuration is reloaded, so they are guarded by a single lock.
+var _config = default_config()
+var _help_template *template.Template
+var _config_lock sync.RWMutex
+
+func config() GemThreadConfig {
+	_config_lock.RLock()
+	defer _config_lock.RUnlock()
+	return _config
+}
+
+func help_template() *template.Template {
+	_config_lock.RLock()
+	defer _config_lock.RUnlock()
+	return _help_template
+}
+
+func set_config(cfg GemThreadConfig, help *template.Template) {
+	_config_lock.Lock()
+	defer _config_lock.Unlock()
+	_config = cfg
+	_help_template = help
+}
+
+func server_url() string {
+	return config().ServerURL
+}
+
+func help_path() string {
+	return config().Templates.HelpPath
+}
+
+func database_path() string {
+	return config().Database.Path
+}
+
+func socket_path() string {
+	return config().Listener.SocketPath
+}
+
+func listen_mode() string {
+	return config().Listener.Mode
+}
+
+func listen_address() string {
+	return config().Listener.Address
+}
+
+func certificate_path() string {
+	return config().Listener.CertificatePath
+}
+
+func key_path() string {
+	return config().Listener.KeyPath
+}
+
+// Reads and validates a configuration file. Both the TOML format and the original
+// "key: value" format are accepted.
+func load_config(config_path string) (GemThreadConfig, error) {
+
+	cfg := default_config()
+
+	config_data, err := ioutil.ReadFile(config_path)
+	if err != nil {
+		return cfg, err
+	}
+
+	config_text := string(config_data)
+
+	if is_legacy_config(config_text) {
+		err = parse_legacy_config(config_text, &cfg)
+	} else {
+		err = parse_toml_config(config_text, &cfg)
+	}
+
+	if err != nil {
+		return cfg, errors.New(config_path + ": " + err.Error())
+	}
+
+	cfg.ServerURL = strings.TrimSuffix(strings.TrimSpace(cfg.ServerURL), "/")
+	cfg.Listener.Mode = strings.ToLower(strings.TrimSpace(cfg.Listener.Mode))
+	cfg.Fetcher.TofuPolicy = strings.ToLower(strings.TrimSpace(cfg.Fetcher.TofuPolicy))
+
+	err = cfg.validate()
+	if err != nil {
+		return cfg, errors.New(config_path + ": " + err.Error())
+	}
+
+	return cfg, nil
+}
+
+// Reads and parses the help file template.
+func load_help_template(help_path string) (*template.Template, error) {
+
+	// Fail if file does not exist or perms aren't right
+	info, err := os.Stat(help_path)
+	if err != nil {
+		return nil, err
+	} else if uint64(info.Mode().Perm())&0444 != 0444 {
+		return nil, errors.New("help file is not readable: " + help_path)
+	}
+
+	help_data, err := ioutil.ReadFile(help_path)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := template.New("help").Parse(string(help_data))
+	if err != nil {
+		return nil, errors.New("error while parsing help file template: " + err.Error())
+	}
+
+	return t, nil
+}
+
+// Re-reads the configuration file and help template. The running configuration is
+// only replaced if both load successfully. The listener and the database are opened
+// once at startup, so changes to their settings are reported and ignored.
+func reload_config(config_path string) error {
+
+	cfg, err := load_config(config_path)
+	if err != nil {
+		return err
+	}
+
+	help, err := load_help_template(cfg.Templates.HelpPath)
+	if err != nil {
+		return err
+	}
+
+	running := config()
+
+	if cfg.Listener != running.Listener {
+		fmt.Println("Listener settings cannot be changed without a restart; keeping the running settings")
+		cfg.Listener = running.Listener
+	}
+
+	if cfg.Database != running.Database {
+		fmt.Println("Database settings cannot be changed without a restart; keeping the running settings")
+		cfg.Database = running.Database
+	}
+
+	if cfg.Queue.Workers != running.Queue.Workers {
+		fmt.Println("The number of queue workers cannot be changed without a restart; keeping the running number")
+		cfg.Queue.Workers = running.Queue.Workers
+	}
+
+	set_config(cfg, help)
+
+	return nil
+}
+
+func (cfg GemThreadConfig) validate() error {
+
+	if len(cfg.ServerURL) == 0 || !strings.HasPrefix(cfg.ServerURL, "gemini://") {
+		return fmt.Errorf("invalid gemthread URL: %s", cfg.ServerURL)
+	}
+
+	if _, err := url.Parse(cfg.ServerURL); err != nil {
+		return fmt.Errorf("invalid gemthread URL: %s", err.Error())
+	}
+
+	if len(cfg.Templates.HelpPath) == 0 {
+		return errors.New("invalid help file path: " + cfg.Templates.HelpPath)
+	}
+
+	if len(cfg.Database.Path) == 0 {
+		return errors.New("invalid database path: " + cfg.Database.Path)
+	}
+
+	if _, ok := transports[cfg.Listener.Mode]; !ok && cfg.Listener.Mode != "cgi" {
+		return errors.New("invalid listen mode: " + cfg.Listener.Mode)
+	}
+
+	if cfg.Listener.ShutdownTimeout.Duration < 0 {
+		return errors.New("invalid shutdown timeout: " + cfg.Listener.ShutdownTimeout.String())
+	}
+
+	if cfg.Fetcher.MaxRedirects < 0 {
+		return fmt.Errorf("invalid maximum number of redirects: %d", cfg.Fetcher.MaxRedirects)
+	}
+
+	if cfg.Fetcher.ConnectTimeout.Duration <= 0 || cfg.Fetcher.HeaderTimeout.Duration <= 0 || cfg.Fetcher.BodyTimeout.Duration <= 0 {
+		return errors.New("fetcher timeouts must be greater than zero")
+	}
+
+	switch cfg.Fetcher.TofuPolicy {
+	case "reject", "flag", "off":
+	default:
+		return errors.New("invalid TOFU policy: " + cfg.Fetcher.TofuPolicy)
+	}
+
+	if _, err := parse_networks(cfg.Fetcher.BlockedNetworks); err != nil {
+		return errors.New("invalid blocked network: " + err.Error())
+	}
+
+	if _, err := parse_networks(cfg.Fetcher.AllowedNetworks); err != nil {
+		return errors.New("invalid allowed network: " + err.Error())
+	}
+
+	if cfg.Fetcher.MaxBodySize <= 0 {
+		return fmt.Errorf("invalid maximum body size: %d", cfg.Fetcher.MaxBodySize)
+	}
+
+	if cfg.Fetcher.HostFetchesPerMinute < 0 {
+		return fmt.Errorf("invalid host fetch rate: %d", cfg.Fetcher.HostFetchesPerMinute)
+	}
+
+	if cfg.Fetcher.HostFetchesPerMinute > 0 && cfg.Fetcher.HostBurst < 1 {
+		return fmt.Errorf("invalid host burst: %d", cfg.Fetcher.HostBurst)
+	}
+
+	if cfg.Fetcher.MinHostInterval.Duration < 0 || cfg.Fetcher.RefetchCooldown.Duration < 0 {
+		return errors.New("host fetch intervals may not be negative")
+	}
+
+	if cfg.Limits.Window.Duration <= 0 {
+		return errors.New("invalid submission limit window: " + cfg.Limits.Window.String())
+	}
+
+	if cfg.Limits.NewThreads < 0 || cfg.Limits.Responses < 0 || cfg.Limits.Refetches < 0 {
+		return errors.New("submission limits may not be negative")
+	}
+
+	if cfg.Queue.Workers < 1 {
+		return fmt.Errorf("invalid number of queue workers: %d", cfg.Queue.Workers)
+	}
+
+	if cfg.Queue.MaxAttempts < 1 {
+		return fmt.Errorf("invalid maximum number of attempts: %d", cfg.Queue.MaxAttempts)
+	}
+
+	if cfg.Queue.RetryDelay.Duration <= 0 || cfg.Queue.MaxRetryDelay.Duration < cfg.Queue.RetryDelay.Duration {
+		return errors.New("the retry delay must be greater than zero and no greater than the maximum retry delay")
+	}
+
+	if cfg.Refresh.Interval.Duration <= 0 {
+		return errors.New("invalid refresh interval: " + cfg.Refresh.Interval.String())
+	}
+
+	if cfg.Refresh.Jitter.Duration < 0 || cfg.Refresh.Jitter.Duration >= cfg.Refresh.Interval.Duration {
+		return errors.New("the refresh jitter must be at least zero and less than the refresh interval")
+	}
+
+	if cfg.Refresh.UnreachableAfter < 1 {
+		return fmt.Errorf("invalid number of checks before a message is unreachable: %d", cfg.Refresh.UnreachableAfter)
+	}
+
+	return nil
+}
+
+var legacy_line_rx = regexp.MustCompile(`^[A-Za-z_]+[\s]*:`)
+
+// The original configuration format has one "key: value" pair per line. TOML
+// never has a colon directly after a bare key, so the first setting tells us which
+// format the file is in.
+func is_legacy_config(config_text string) bool {
+	for _, line := range strings.Split(config_text, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		return legacy_line_rx.MatchString(line)
+	}
+	return false
+}
+
+func parse_legacy_config(config_text string, cfg *GemThreadConfig) error {
+
+	for i, line := range strings.Split(config_text, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("line %d: invalid configuration line: %s", i+1, line)
+		}
+		value := strings.TrimSpace(parts[1])
+		switch strings.ToUpper(strings.TrimSpace(parts[0])) {
+		case "SERVER_URL":
+			cfg.ServerURL = value
+		case "HELP_PATH":
+			cfg.Templates.HelpPath = value
+		case "DATABASE_PATH":
+			cfg.Database.Path = value
+		case "SOCKET_PATH":
+			cfg.Listener.SocketPath = value
+		case "LISTEN_MODE":
+			cfg.Listener.Mode = value
+		case "LISTEN_ADDRESS":
+			cfg.Listener.Address = value
+		case "CERTIFICATE_PATH":
+			cfg.Listener.CertificatePath = value
+		case "KEY_PATH":
+			cfg.Listener.KeyPath = value
+		default:
+			return fmt.Errorf("line %d: unknown configuration key: %s", i+1, strings.TrimSpace(parts[0]))
+		}
+	}
+
+	return nil
+}
+
+func parse_toml_config(config_text string, cfg *GemThreadConfig) error {
+
+	md, err := toml.Decode(config_text, cfg)
+	if err != nil {
+		return err
+	}
+
+	undecoded := md.Undecoded()
+	if len(undecoded) == 0 {
+		return nil
+	}
+
+	key_lines := scan_toml_key_lines(config_text)
+
+	type key_error struct {
+		line int
+		msg  string
+	}
+
+	var key_errs []key_error
+	reported := make(map[string]bool)
+
+	for _, key := range undecoded {
+		name := key.String()
+		// An unknown table makes every key in it unknown; report the table only.
+		if len(key) > 1 && reported[key[:len(key)-1].String()] {
+			reported[name] = true
+			continue
+		}
+		reported[name] = true
+		line, ok := key_lines[name]
+		if ok {
+			key_errs = append(key_errs, key_error{line, fmt.Sprintf("line %d: unknown configuration key: %s", line, name)})
+		} else {
+			key_errs = append(key_errs, key_error{0, "unknown configuration key: " + name})
+		}
+	}
+
+	sort.SliceStable(key_errs, func(i, j int) bool {
+		return key_errs[i].line < key_errs[j].line
+	})
+
+	var errs []string
+	for _, ke := range key_errs {
+		errs = append(errs, ke.msg)
+	}
+
+	return errors.New(strings.Join(errs, "; "))
+}
+
+// Maps each table and key in a TOML document to the line on which it is defined.
+// The TOML decoder does not report positions for keys it did not use, so this is
+// a deliberately simple scan that understands table headers and "key = value" lines.
+func scan_toml_key_lines(config_text string) map[string]int {
+
+	key_lines := make(map[string]int)
+	table := ""
+
+	for i, line := range strings.Split(config_text, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			end := strings.LastIndex(line, "]")
+			if end < 0 {
+				continue
+			}
+			table = strings.Trim(line[:end], "[] \t")
+			table = strings.ReplaceAll(table, "\"", "")
+			if _, ok := key_lines[table]; !ok {
+				key_lines[table] = i + 1
+			}
+			continue
+		}
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			continue
+		}
+		key := strings.Trim(strings.TrimSpace(line[:eq]), "\"")
+		if len(table) > 0 {
+			key = table + "." + key
+		}
+		if _, ok := key_lines[key]; !ok {
+			key_lines[key] = i + 1
+		}
+	}
+
+	return key_lines
+}
@@ -14,51 +14,44 @@ func db_drop_tables(db *sql.DB) error {
 	sqlStmt := `
    drop table messages;
 	drop table threads;
+	drop table if exists message_search;
+	drop table if exists schema_version;
 	`
 	_, err := db.Exec(sqlStmt)
 	return err
 }
 
-func db_create_tables(db *sql.DB) error {
+func db_add_column_if_missing(tx *sql.Tx, table string, column string, definition string) error {
 
-	sqlStmt := `
-	create table if not exists threads (
-	   id integer not null primary key, 
-		author text not null,
-		title text not null,
-		dt_created text not null,
-		dt_updated text not null
-	);
-	create table if not exists messages (
-	   id integer not null primary key, 
-		url text not null,
-		author text not null,
-		title text not null,
-		dt_created text not null,
-		summary text
-	);
-	create unique index if not exists url_index on messages(url);
-   create table if not exists responses (
-                        threads_id integer,
-                        messages_id integer,
-		                  dt_created text not null,
-                        foreign key(threads_id) references threads(id),
-                        foreign key(messages_id) references messages(id)
-                );
-   create table if not exists originations (
-                        messages_id integer,
-                        threads_id integer,
-                        foreign key(messages_id) references messages(id),
-                        foreign key(threads_id) references threads(id)
-                );
-	`
-	_, err := db.Exec(sqlStmt)
-	return err
+	rows, err := tx.Query("select name from pragma_table_info(?)", table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
 
+	_, err = tx.Exec("alter table " + table + " add column " + column + " " + definition)
+	return err
 }
 
 func db_open(database_path string, should_drop bool) (*sql.DB, error) {
-	db, err := sql.Open("sqlite3", database_path)
+	// Request handlers, queue workers and the refresher all write to the database, so
+	// wait for a lock rather than failing with "database is locked". SQLite only
+	// enforces foreign keys, and cascades deletes along them, when asked to on each
+	// connection.
+	db, err := sql.Open("sqlite3", database_path+"?_busy_timeout=10000&_foreign_keys=1")
 	if err != nil {
 		return nil, err
 	}
@@ -70,7 +63,15 @@ func db_open(database_path string, should_drop bool) (*sql.DB, error) {
 		}
 	}
 
-	err = db_create_tables(db)
+	applied, err := db_migrate(database_path)
+	log_migrations(applied)
+	if err != nil {
+		return nil, err
+	}
+
+	// The search index is not versioned, as it depends on whether this build of
+	// SQLite has FTS5
+	err = db_create_search_index(db)
 	if err != nil {
 		return nil, err
 	}
@@ -206,6 +207,7 @@ func db_insert_message(db *sql.DB, msg GemThreadMessage, tx *sql.Tx) (int64, err
 		if err != nil {
 			return -1, err
 		}
+		defer tx.Rollback()
 	}
 
 	msg_stmt, err := tx.Prepare("insert into messages(url, author, title, dt_created, summary) values(?, ?, ?, ?, ?)")
@@ -245,6 +247,7 @@ func db_update_message(db *sql.DB, msg GemThreadMessage, tx *sql.Tx) (int64, err
 		if err != nil {
 			return -1, err
 		}
+		defer tx.Rollback()
 	}
 
 	msg_stmt, err := tx.Prepare("update messages set author = ?, title = ?, summary = ? where id = ?")
@@ -285,39 +288,23 @@ func db_update_message(db *sql.DB, msg GemThreadMessage, tx *sql.Tx) (int64, err
 	return msg.id, err
 }
 
+// Removes a message. Its responses, origination, checks, snapshot and revisions go with
+// it, but a thread that it started is kept along with the thread's other responses.
 func db_delete_message(db *sql.DB, msg GemThreadMessage) (int64, error) {
 
 	tx, err := db.Begin()
 	if err != nil {
 		return -1, err
 	}
+	defer tx.Rollback()
 
-	msg_stmt, err := tx.Prepare("delete from messages where id = ?")
-	if err != nil {
-		return -1, err
-	}
-	defer msg_stmt.Close()
-	_, err = msg_stmt.Exec(msg.id)
-	if err != nil {
-		return -1, err
-	}
-
-	msg_resp_stmt, err := tx.Prepare("delete from responses where messages_id = ?")
-	if err != nil {
-		return -1, err
-	}
-	defer msg_resp_stmt.Close()
-	_, err = msg_resp_stmt.Exec(msg.id)
+	_, err = tx.Exec("delete from messages where id = ?", msg.id)
 	if err != nil {
 		return -1, err
 	}
 
-	msg_orig_stmt, err := tx.Prepare("delete from originations where messages_id = ?")
-	if err != nil {
-		return -1, err
-	}
-	defer msg_orig_stmt.Close()
-	_, err = msg_orig_stmt.Exec(msg.id)
+	// Replies to the message now reply to the thread itself
+	_, err = tx.Exec("update responses set parent_message_id = 0 where parent_message_id = ?", msg.id)
 	if err != nil {
 		return -1, err
 	}
@@ -387,7 +374,9 @@ func db_insert_originating_message(db *sql.DB, thread_id int64, msg GemThreadMes
 	return msg.id, err
 }
 
-func db_insert_response_message(db *sql.DB, thread_id int64, msg GemThreadMessage) (int64, error) {
+// Adds msg as a response to a thread. parent_id is the ID of the response in the
+// thread that msg replies to, or 0 if it replies to the thread itself.
+func db_insert_response_message(db *sql.DB, thread_id int64, msg GemThreadMessage, parent_id int64) (int64, error) {
 
 	var err error
 
@@ -395,6 +384,7 @@ func db_insert_response_message(db *sql.DB, thread_id int64, msg GemThreadMessag
 	if err != nil {
 		return -1, err
 	}
+	defer tx.Rollback()
 
 	// Look for a message with this URL that already exists
 	existing, err := db_find_existing_message_by_url(db, msg.url)
@@ -433,12 +423,27 @@ func db_insert_response_message(db *sql.DB, thread_id int64, msg GemThreadMessag
 		}
 	}
 
-	thr_resp_stmt, err := tx.Prepare("insert into responses(threads_id, messages_id, dt_created) values(?, ?, ?)")
+	// A message that already responds to the thread keeps its place in it
+	var count int
+	err = tx.QueryRow("select count(*) from responses where threads_id = ? and messages_id = ?", thread_id, msg.id).Scan(&count)
+	if err != nil {
+		return -1, err
+	}
+	if count > 0 {
+		_, err = tx.Exec("update responses set parent_message_id = ? where threads_id = ? and messages_id = ?", parent_id, thread_id, msg.id)
+		if err != nil {
+			return -1, err
+		}
+		err = tx.Commit()
+		return msg.id, err
+	}
+
+	thr_resp_stmt, err := tx.Prepare("insert into responses(threads_id, messages_id, dt_created, parent_message_id) values(?, ?, ?, ?)")
 	if err != nil {
 		return -1, err
 	}
 	defer thr_resp_stmt.Close()
-	_, err = thr_resp_stmt.Exec(thread_id, msg.id, dt_created)
+	_, err = thr_resp_stmt.Exec(thread_id, msg.id, dt_created, parent_id)
 	if err != nil {
 		return -1, err
 	}
@@ -466,6 +471,7 @@ func db_create_new_thread(db *sql.DB, msg GemThreadMessage) (int64, error) {
 	if err != nil {
 		return thr_id, err
 	}
+	defer tx.Rollback()
 
 	existing_msg, err := db_find_existing_message_by_url(db, msg.url)
 	if err != nil {
@@ -691,3 +697,700 @@ func db_find_messages_for_thread(db *sql.DB, thr_id int64, ascending bool) ([]Ge
 
 	return msgs, nil
 }
+
+func now_timestamp() string {
+	return format_timestamp(time.Now())
+}
+
+func format_timestamp(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05Z")
+}
+
+func db_find_known_host(db *sql.DB, hostname string) (GemThreadKnownHost, error) {
+
+	var host = GemThreadKnownHost{}
+
+	stmt, err := db.Prepare("select hostname, fingerprint, not_after, dt_created, dt_updated from known_hosts where hostname = ?")
+	if err != nil {
+		return host, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(hostname)
+	if err != nil {
+		return host, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		err = rows.Scan(&host.hostname, &host.fingerprint, &host.not_after, &host.dt_created, &host.dt_updated)
+		if err != nil {
+			return host, err
+		}
+	}
+	return host, rows.Err()
+}
+
+// Records the certificate for a host, replacing any certificate previously recorded for it.
+func db_save_known_host(db *sql.DB, host GemThreadKnownHost) error {
+
+	dt_now := now_timestamp()
+
+	stmt, err := db.Prepare("insert into known_hosts(hostname, fingerprint, not_after, dt_created, dt_updated) values(?, ?, ?, ?, ?) on conflict(hostname) do update set fingerprint = excluded.fingerprint, not_after = excluded.not_after, dt_updated = excluded.dt_updated")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(host.hostname, host.fingerprint, host.not_after, dt_now, dt_now)
+	return err
+}
+
+// Records a certificate that differs from the one recorded for its host, so that an
+// administrator can review it. A certificate that is already awaiting review is not
+// recorded twice.
+func db_insert_known_host_change(db *sql.DB, host GemThreadKnownHost) error {
+
+	stmt, err := db.Prepare("insert into known_host_changes(hostname, fingerprint, not_after, dt_created) select ?, ?, ?, ? where not exists (select 1 from known_host_changes where hostname = ? and fingerprint = ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(host.hostname, host.fingerprint, host.not_after, now_timestamp(), host.hostname, host.fingerprint)
+	return err
+}
+
+func db_list_known_host_changes(db *sql.DB) ([]GemThreadKnownHost, error) {
+
+	var hosts = []GemThreadKnownHost{}
+
+	stmt, err := db.Prepare("select hostname, fingerprint, not_after, dt_created from known_host_changes order by dt_created asc")
+	if err != nil {
+		return hosts, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query()
+	if err != nil {
+		return hosts, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		host := GemThreadKnownHost{}
+		err = rows.Scan(&host.hostname, &host.fingerprint, &host.not_after, &host.dt_created)
+		if err != nil {
+			return hosts, err
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, rows.Err()
+}
+
+// Accepts the most recent certificate awaiting review for a host as its known
+// certificate, and clears the host's pending changes.
+func db_approve_known_host_change(db *sql.DB, hostname string) error {
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var host = GemThreadKnownHost{hostname: hostname}
+
+	err = tx.QueryRow("select fingerprint, not_after from known_host_changes where hostname = ? order by id desc limit 1", hostname).Scan(&host.fingerprint, &host.not_after)
+	if err == sql.ErrNoRows {
+		return errors.New("no certificate change is awaiting review for " + hostname)
+	} else if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("update known_hosts set fingerprint = ?, not_after = ?, dt_updated = ? where hostname = ?", host.fingerprint, host.not_after, now_timestamp(), hostname)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("delete from known_host_changes where hostname = ?", hostname)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func db_insert_submission(db *sql.DB, kind submission_kind, tgt_url string, thread_id int64) (int64, error) {
+
+	dt_now := now_timestamp()
+
+	stmt, err := db.Prepare("insert into submissions(kind, url, threads_id, status, dt_next_attempt, dt_created, dt_updated) values(?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return -1, err
+	}
+	defer stmt.Close()
+
+	res, err := stmt.Exec(string(kind), tgt_url, thread_id, submission_pending, dt_now, dt_now, dt_now)
+	if err != nil {
+		return -1, err
+	}
+
+	return res.LastInsertId()
+}
+
+const submission_columns = "id, kind, url, threads_id, status, attempts, last_error, result_threads_id, dt_next_attempt, dt_created, dt_updated"
+
+func scan_submission(row *sql.Row, sub *GemThreadSubmission) error {
+	var kind string
+	err := row.Scan(&sub.id, &kind, &sub.url, &sub.threads_id, &sub.status, &sub.attempts, &sub.last_error, &sub.result_threads_id, &sub.dt_next_attempt, &sub.dt_created, &sub.dt_updated)
+	sub.kind = submission_kind(kind)
+	return err
+}
+
+// Returns the submission with the given ID, or a submission with an ID of zero if
+// there is none.
+func db_find_submission_by_id(db *sql.DB, sub_id int64) (GemThreadSubmission, error) {
+
+	var sub = GemThreadSubmission{}
+
+	err := scan_submission(db.QueryRow("select "+submission_columns+" from submissions where id = ?", sub_id), &sub)
+	if err == sql.ErrNoRows {
+		return GemThreadSubmission{}, nil
+	}
+
+	return sub, err
+}
+
+// Marks the pending submission that has been waiting longest, and whose next attempt
+// is due, as running and returns it. The returned submission has an ID of zero if no
+// submission is due.
+func db_claim_submission(db *sql.DB) (GemThreadSubmission, error) {
+
+	for {
+		var sub = GemThreadSubmission{}
+
+		dt_now := now_timestamp()
+
+		err := scan_submission(db.QueryRow("select "+submission_columns+" from submissions where status = ? and dt_next_attempt <= ? order by dt_next_attempt asc, id asc limit 1", submission_pending, dt_now), &sub)
+		if err == sql.ErrNoRows {
+			return GemThreadSubmission{}, nil
+		} else if err != nil {
+			return sub, err
+		}
+
+		sub.status = submission_running
+		sub.attempts++
+
+		// Another worker, possibly in another process, may have claimed it first
+		res, err := db.Exec("update submissions set status = ?, attempts = ?, dt_updated = ? where id = ? and status = ?", sub.status, sub.attempts, dt_now, sub.id, submission_pending)
+		if err != nil {
+			return GemThreadSubmission{}, err
+		}
+
+		claimed, err := res.RowsAffected()
+		if err != nil {
+			return GemThreadSubmission{}, err
+		}
+		if claimed == 1 {
+			return sub, nil
+		}
+	}
+}
+
+// Records the outcome of a submission's latest attempt.
+func db_update_submission(db *sql.DB, sub GemThreadSubmission) error {
+
+	stmt, err := db.Prepare("update submissions set status = ?, attempts = ?, last_error = ?, result_threads_id = ?, dt_next_attempt = ?, dt_updated = ? where id = ?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(sub.status, sub.attempts, sub.last_error, sub.result_threads_id, sub.dt_next_attempt, now_timestamp(), sub.id)
+	return err
+}
+
+// Returns submissions that have been marked as running since before the given time to
+// the queue.
+func db_requeue_running_submissions(db *sql.DB, before time.Time) error {
+	_, err := db.Exec("update submissions set status = ?, dt_updated = ? where status = ? and dt_updated < ?", submission_pending, now_timestamp(), submission_running, format_timestamp(before))
+	return err
+}
+
+// Records the threads that a response submitted to /respond was added to, or that its
+// submitter may choose from.
+func db_save_submission_threads(db *sql.DB, sub_id int64, thr_ids []int64) error {
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("delete from submission_threads where submissions_id = ?", sub_id)
+	if err != nil {
+		return err
+	}
+
+	for _, thr_id := range thr_ids {
+		_, err = tx.Exec("insert into submission_threads(submissions_id, threads_id) values(?, ?)", sub_id, thr_id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func db_find_submission_threads(db *sql.DB, sub_id int64) ([]GemThreadThread, error) {
+
+	var thrs = []GemThreadThread{}
+
+	rows, err := db.Query("select id, author, title, dt_created, dt_updated from threads INNER JOIN submission_threads on threads.id = submission_threads.threads_id WHERE submission_threads.submissions_id = ? order by id", sub_id)
+	if err != nil {
+		return thrs, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var thr = GemThreadThread{}
+		err = rows.Scan(&thr.id, &thr.author, &thr.title, &thr.dt_created, &thr.dt_updated)
+		if err != nil {
+			return thrs, err
+		}
+		thrs = append(thrs, thr)
+	}
+	return thrs, rows.Err()
+}
+
+func db_find_message_check(db *sql.DB, msg_id int64) (GemThreadMessageCheck, error) {
+
+	var check = GemThreadMessageCheck{}
+
+	err := db.QueryRow("select messages_id, dt_checked, outcome, detail, dt_next_check, failures, dt_unreachable from message_checks where messages_id = ?", msg_id).Scan(&check.messages_id, &check.dt_checked, &check.outcome, &check.detail, &check.dt_next_check, &check.failures, &check.dt_unreachable)
+	if err == sql.ErrNoRows {
+		return GemThreadMessageCheck{}, nil
+	}
+
+	return check, err
+}
+
+// Records the outcome of a check, or just when the next check is due if dt_checked
+// is empty.
+func db_save_message_check(db *sql.DB, check GemThreadMessageCheck) error {
+
+	stmt, err := db.Prepare("insert into message_checks(messages_id, dt_checked, outcome, detail, dt_next_check, failures, dt_unreachable) values(?, ?, ?, ?, ?, ?, ?) on conflict(messages_id) do update set dt_checked = excluded.dt_checked, outcome = excluded.outcome, detail = excluded.detail, dt_next_check = excluded.dt_next_check, failures = excluded.failures, dt_unreachable = excluded.dt_unreachable")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(check.messages_id, check.dt_checked, check.outcome, check.detail, check.dt_next_check, check.failures, check.dt_unreachable)
+	return err
+}
+
+// Returns the IDs of messages that have never been scheduled for a check.
+func db_list_unscheduled_message_ids(db *sql.DB) ([]int64, error) {
+
+	var ids = []int64{}
+
+	rows, err := db.Query("select id from messages where id not in (select messages_id from message_checks)")
+	if err != nil {
+		return ids, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		err = rows.Scan(&id)
+		if err != nil {
+			return ids, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// Returns the check that is most overdue, or a check with a messages_id of zero if no
+// check is due.
+func db_find_next_message_check(db *sql.DB) (GemThreadMessageCheck, error) {
+
+	var check = GemThreadMessageCheck{}
+
+	err := db.QueryRow("select messages_id, dt_checked, outcome, detail, dt_next_check, failures, dt_unreachable from message_checks where dt_next_check <= ? order by dt_next_check asc limit 1", now_timestamp()).Scan(&check.messages_id, &check.dt_checked, &check.outcome, &check.detail, &check.dt_next_check, &check.failures, &check.dt_unreachable)
+	if err == sql.ErrNoRows {
+		return GemThreadMessageCheck{}, nil
+	}
+
+	return check, err
+}
+
+func db_delete_message_check(db *sql.DB, msg_id int64) error {
+	_, err := db.Exec("delete from message_checks where messages_id = ?", msg_id)
+	return err
+}
+
+// Returns the times since which the unreachable messages in a thread have been
+// unreachable, by message ID.
+func db_find_unreachable_messages_for_thread(db *sql.DB, thr_id int64) (map[int64]string, error) {
+
+	var unreachable = make(map[int64]string)
+
+	rows, err := db.Query("select messages_id, dt_unreachable from message_checks where dt_unreachable != '' and messages_id in (select messages_id from responses where threads_id = ? union select messages_id from originations where threads_id = ?)", thr_id, thr_id)
+	if err != nil {
+		return unreachable, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var msg_id int64
+		var dt_unreachable string
+		err = rows.Scan(&msg_id, &dt_unreachable)
+		if err != nil {
+			return unreachable, err
+		}
+		unreachable[msg_id] = dt_unreachable
+	}
+	return unreachable, rows.Err()
+}
+
+// Records the latest copy of a message's page, replacing any earlier copy.
+func db_save_snapshot(db *sql.DB, snap GemThreadSnapshot) error {
+
+	stmt, err := db.Prepare("insert into snapshots(messages_id, body, content_hash, media_type, dt_fetched) values(?, ?, ?, ?, ?) on conflict(messages_id) do update set body = excluded.body, content_hash = excluded.content_hash, media_type = excluded.media_type, dt_fetched = excluded.dt_fetched")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(snap.messages_id, snap.body, snap.content_hash, snap.media_type, snap.dt_fetched)
+	return err
+}
+
+// Returns the snapshot of a message's page, or a snapshot with a messages_id of zero if
+// there is none.
+func db_find_snapshot(db *sql.DB, msg_id int64) (GemThreadSnapshot, error) {
+
+	var snap = GemThreadSnapshot{}
+
+	err := db.QueryRow("select messages_id, body, content_hash, media_type, dt_fetched from snapshots where messages_id = ?", msg_id).Scan(&snap.messages_id, &snap.body, &snap.content_hash, &snap.media_type, &snap.dt_fetched)
+	if err == sql.ErrNoRows {
+		return GemThreadSnapshot{}, nil
+	}
+
+	return snap, err
+}
+
+// Returns the hash of the last copy of a message's page that was fetched, or "" if
+// none has been recorded.
+func db_find_message_hash(db *sql.DB, msg_id int64) (string, error) {
+
+	var hash string
+
+	err := db.QueryRow("select content_hash from message_hashes where messages_id = ?", msg_id).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+
+	return hash, err
+}
+
+func db_save_message_hash(db *sql.DB, msg_id int64, hash string) error {
+	_, err := db.Exec("insert into message_hashes(messages_id, content_hash) values(?, ?) on conflict(messages_id) do update set content_hash = excluded.content_hash", msg_id, hash)
+	return err
+}
+
+func db_insert_message_revision(tx *sql.Tx, rev GemThreadMessageRevision) error {
+
+	stmt, err := tx.Prepare("insert into message_revisions(messages_id, author, title, summary, content_hash, body, dt_created) values(?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(rev.messages_id, rev.author, rev.title, rev.summary, rev.content_hash, rev.body, now_timestamp())
+	return err
+}
+
+// Returns a message's revisions, oldest first.
+func db_find_message_revisions(db *sql.DB, msg_id int64) ([]GemThreadMessageRevision, error) {
+
+	var revs = []GemThreadMessageRevision{}
+
+	rows, err := db.Query("select id, messages_id, author, title, summary, content_hash, body, dt_created from message_revisions where messages_id = ? order by id asc", msg_id)
+	if err != nil {
+		return revs, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		rev := GemThreadMessageRevision{}
+		var summary sql.NullString
+		err = rows.Scan(&rev.id, &rev.messages_id, &rev.author, &rev.title, &summary, &rev.content_hash, &rev.body, &rev.dt_created)
+		if err != nil {
+			return revs, err
+		}
+		rev.summary = summary.String
+		revs = append(revs, rev)
+	}
+	return revs, rows.Err()
+}
+
+// Returns the time of the latest revision of each message in a thread that has been
+// revised, by message ID.
+func db_find_revised_messages_for_thread(db *sql.DB, thr_id int64) (map[int64]string, error) {
+
+	var revised = make(map[int64]string)
+
+	rows, err := db.Query("select messages_id, max(dt_created) from message_revisions where messages_id in (select messages_id from responses where threads_id = ? union select messages_id from originations where threads_id = ?) group by messages_id", thr_id, thr_id)
+	if err != nil {
+		return revised, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var msg_id int64
+		var dt_revised string
+		err = rows.Scan(&msg_id, &dt_revised)
+		if err != nil {
+			return revised, err
+		}
+		revised[msg_id] = dt_revised
+	}
+	return revised, rows.Err()
+}
+
+// Returns the message that started a thread, or a message with an ID of zero if it
+// has been removed.
+func db_find_originating_message_for_thread(db *sql.DB, thr_id int64) (GemThreadMessage, error) {
+
+	var msg = GemThreadMessage{}
+
+	err := db.QueryRow("select id, url, author, title, dt_created, summary from messages INNER JOIN originations on messages.id = originations.messages_id WHERE originations.threads_id = ?", thr_id).Scan(&msg.id, &msg.url, &msg.author, &msg.title, &msg.dt_created, &msg.summary)
+	if err == sql.ErrNoRows {
+		return GemThreadMessage{}, nil
+	}
+
+	return msg, err
+}
+
+// Returns whether a thread's author has required its responses to link back to it.
+func db_find_thread_policy(db *sql.DB, thr_id int64) (bool, error) {
+
+	var require_backlinks bool
+
+	err := db.QueryRow("select require_backlinks from thread_policies where threads_id = ?", thr_id).Scan(&require_backlinks)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+
+	return require_backlinks, err
+}
+
+func db_save_thread_policy(db *sql.DB, thr_id int64, require_backlinks bool) error {
+	_, err := db.Exec("insert into thread_policies(threads_id, require_backlinks) values(?, ?) on conflict(threads_id) do update set require_backlinks = excluded.require_backlinks", thr_id, require_backlinks)
+	return err
+}
+
+// Reports whether a message is a response in a thread.
+func db_is_response_in_thread(db *sql.DB, thr_id int64, msg_id int64) (bool, error) {
+
+	var count int
+
+	err := db.QueryRow("select count(*) from responses where threads_id = ? and messages_id = ?", thr_id, msg_id).Scan(&count)
+
+	return count > 0, err
+}
+
+func db_update_response_parent(db *sql.DB, thr_id int64, msg_id int64, parent_id int64) error {
+	_, err := db.Exec("update responses set parent_message_id = ? where threads_id = ? and messages_id = ?", parent_id, thr_id, msg_id)
+	return err
+}
+
+// Returns the response that each response in a thread replies to, by message ID, for
+// the responses that reply to another response rather than to the thread itself.
+func db_find_reply_parents_for_thread(db *sql.DB, thr_id int64) (map[int64]int64, error) {
+
+	var parents = make(map[int64]int64)
+
+	rows, err := db.Query("select messages_id, parent_message_id from responses where threads_id = ? and parent_message_id != 0", thr_id)
+	if err != nil {
+		return parents, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var msg_id, parent_id int64
+		err = rows.Scan(&msg_id, &parent_id)
+		if err != nil {
+			return parents, err
+		}
+		parents[msg_id] = parent_id
+	}
+	return parents, rows.Err()
+}
+
+// Creates the full-text search index and the triggers that keep it in step with the
+// messages and snapshots tables, and fills it from them if it is new or has missed
+// changes. If this build of SQLite lacks FTS5, the index is not created, its
+// triggers are dropped, and searches are refused.
+func db_create_search_index(db *sql.DB) error {
+
+	// "create virtual table if not exists" succeeds without loading FTS5 when the
+	// table already exists, so ask SQLite whether it was built with it
+	err := db.QueryRow("select sqlite_compileoption_used('ENABLE_FTS5')").Scan(&_fts5_available)
+	if err != nil {
+		return err
+	}
+	if !_fts5_available {
+		// Writes to the messages table would fail in the triggers
+		return db_drop_search_triggers(db)
+	}
+
+	var count int
+	err = db.QueryRow("select count(*) from sqlite_master where type = 'table' and name = 'message_search'").Scan(&count)
+	if err != nil {
+		return err
+	}
+	is_new := count == 0
+
+	// The triggers are dropped while the database is used without FTS5, and by
+	// migrations that rebuild the tables, and the index is out of date once they are
+	err = db.QueryRow("select count(*) from sqlite_master where type = 'trigger' and name = 'message_search_insert'").Scan(&count)
+	if err != nil {
+		return err
+	}
+	is_stale := !is_new && count == 0
+
+	_, err = db.Exec("create virtual table if not exists message_search using fts5(title, author, summary, body)")
+	if err != nil {
+		return err
+	}
+
+	sqlStmt := `
+	create trigger if not exists message_search_insert after insert on messages begin
+		insert into message_search(rowid, title, author, summary, body) values(new.id, new.title, new.author, coalesce(new.summary, ''), '');
+	end;
+	create trigger if not exists message_search_update after update on messages begin
+		update message_search set title = new.title, author = new.author, summary = coalesce(new.summary, '') where rowid = new.id;
+	end;
+	create trigger if not exists message_search_delete after delete on messages begin
+		delete from message_search where rowid = old.id;
+	end;
+	create trigger if not exists message_search_snapshot_insert after insert on snapshots begin
+		update message_search set body = new.body where rowid = new.messages_id;
+	end;
+	create trigger if not exists message_search_snapshot_update after update on snapshots begin
+		update message_search set body = new.body where rowid = new.messages_id;
+	end;
+	create trigger if not exists message_search_snapshot_delete after delete on snapshots begin
+		update message_search set body = '' where rowid = old.messages_id;
+	end;
+	`
+	_, err = db.Exec(sqlStmt)
+	if err != nil {
+		return err
+	}
+
+	if is_stale {
+		_, err = db.Exec("delete from message_search")
+		if err != nil {
+			return err
+		}
+	}
+
+	if is_new || is_stale {
+		_, err = db.Exec("insert into message_search(rowid, title, author, summary, body) select messages.id, title, author, coalesce(summary, ''), coalesce(snapshots.body, '') from messages left join snapshots on snapshots.messages_id = messages.id")
+	}
+
+	return err
+}
+
+const drop_search_triggers = `
+	drop trigger if exists message_search_insert;
+	drop trigger if exists message_search_update;
+	drop trigger if exists message_search_delete;
+	drop trigger if exists message_search_snapshot_insert;
+	drop trigger if exists message_search_snapshot_update;
+	drop trigger if exists message_search_snapshot_delete;
+	`
+
+func db_drop_search_triggers(db *sql.DB) error {
+	_, err := db.Exec(drop_search_triggers)
+	return err
+}
+
+// Returns the messages that match an FTS5 query, best match first, along with a
+// snippet of the text around the match in each.
+func db_search_messages(db *sql.DB, fts_query string, limit int) ([]search_hit, error) {
+
+	var hits = []search_hit{}
+
+	rows, err := db.Query("select messages.id, url, messages.author, messages.title, dt_created, messages.summary, snippet(message_search, -1, ?, ?, '…', 16) from message_search INNER JOIN messages on messages.id = message_search.rowid WHERE message_search match ? ORDER BY rank LIMIT ?", search_highlight, search_highlight, fts_query, limit)
+	if err != nil {
+		return hits, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hit = search_hit{}
+		err = rows.Scan(&hit.msg.id, &hit.msg.url, &hit.msg.author, &hit.msg.title, &hit.msg.dt_created, &hit.msg.summary, &hit.snippet)
+		if err != nil {
+			return hits, err
+		}
+		hits = append(hits, hit)
+	}
+	return hits, rows.Err()
+}
+
+type db_dangling_row struct {
+	table  string
+	rowid  int64
+	parent string
+}
+
+// Returns the rows that refer to a message, thread or submission that does not
+// exist, as reported by SQLite's foreign key check.
+func db_find_dangling_rows(tx *sql.Tx) ([]db_dangling_row, error) {
+
+	var dangling []db_dangling_row
+
+	rows, err := tx.Query("pragma foreign_key_check")
+	if err != nil {
+		return dangling, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var row db_dangling_row
+		var fkid int64
+		err = rows.Scan(&row.table, &row.rowid, &row.parent, &fkid)
+		if err != nil {
+			return dangling, err
+		}
+		// A row that refers to more than one missing row is reported once for each
+		n := len(dangling)
+		if n > 0 && dangling[n-1].table == row.table && dangling[n-1].rowid == row.rowid {
+			dangling[n-1].parent += " and " + row.parent
+			continue
+		}
+		dangling = append(dangling, row)
+	}
+	return dangling, rows.Err()
+}
+
+// Removes the rows that refer to a message, thread or submission that does not
+// exist, such as rows left by older versions of gemthread, and returns them.
+func db_delete_dangling_rows(db *sql.DB) ([]db_dangling_row, error) {
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	dangling, err := db_find_dangling_rows(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, row := range dangling {
+		_, err = tx.Exec("delete from "+row.table+" where rowid = ?", row.rowid)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return dangling, tx.Commit()
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// A minimal FastCGI responder. Requests are not multiplexed: each connection carries
+// at most one request at a time, which is what Gemini servers that speak FastCGI do.
+//
+// The net/http/fcgi package is not used because it writes HTTP response headers,
+// whereas a Gemini FastCGI responder writes the Gemini response header itself.
+
+const (
+	fcgi_version = 1
+
+	fcgi_begin_request     = 1
+	fcgi_abort_request     = 2
+	fcgi_end_request       = 3
+	fcgi_params            = 4
+	fcgi_stdin             = 5
+	fcgi_stdout            = 6
+	fcgi_get_values        = 9
+	fcgi_get_values_result = 10
+	fcgi_unknown_type      = 11
+
+	fcgi_role_responder = 1
+	fcgi_flag_keep_conn = 1
+
+	fcgi_request_complete = 0
+	fcgi_cant_mpx_conn    = 1
+	fcgi_unknown_role     = 3
+
+	fcgi_max_content = 65535
+)
+
+type fastcgi_record struct {
+	rec_type   uint8
+	request_id uint16
+	content    []byte
+}
+
+func read_fastcgi_record(r io.Reader) (fastcgi_record, error) {
+
+	var rec fastcgi_record
+	var header [8]byte
+
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return rec, err
+	}
+
+	if header[0] != fcgi_version {
+		return rec, fmt.Errorf("unsupported FastCGI version %d", header[0])
+	}
+
+	rec.rec_type = header[1]
+	rec.request_id = binary.BigEndian.Uint16(header[2:4])
+	content_length := int(binary.BigEndian.Uint16(header[4:6]))
+	padding_length := int(header[6])
+
+	content := make([]byte, content_length+padding_length)
+	_, err = io.ReadFull(r, content)
+	if err != nil {
+		return rec, errors.New("error reading FastCGI record: " + err.Error())
+	}
+
+	rec.content = content[:content_length]
+
+	return rec, nil
+}
+
+// Writes content as one or more records of the given type. Empty content writes a
+// single empty record, which terminates a stream.
+func write_fastcgi_record(w io.Writer, rec_type uint8, request_id uint16, content []byte) error {
+
+	for {
+		chunk := content
+		if len(chunk) > fcgi_max_content {
+			chunk = chunk[:fcgi_max_content]
+		}
+		content = content[len(chunk):]
+
+		padding_length := -len(chunk) & 7
+
+		var header [8]byte
+		header[0] = fcgi_version
+		header[1] = rec_type
+		binary.BigEndian.PutUint16(header[2:4], request_id)
+		binary.BigEndian.PutUint16(header[4:6], uint16(len(chunk)))
+		header[6] = uint8(padding_length)
+
+		_, err := w.Write(header[:])
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(chunk)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(make([]byte, padding_length))
+		if err != nil {
+			return err
+		}
+
+		if len(content) == 0 {
+			return nil
+		}
+	}
+}
+
+func write_fastcgi_end_request(w io.Writer, request_id uint16, protocol_status uint8) error {
+	var body [8]byte
+	// The application status (body[0:4]) is always zero
+	body[4] = protocol_status
+	return write_fastcgi_record(w, fcgi_end_request, request_id, body[:])
+}
+
+func read_fastcgi_length(data []byte) (int, []byte, error) {
+	if len(data) < 1 {
+		return 0, nil, errors.New("truncated FastCGI name-value pair")
+	}
+	if data[0]&0x80 == 0 {
+		return int(data[0]), data[1:], nil
+	}
+	if len(data) < 4 {
+		return 0, nil, errors.New("truncated FastCGI name-value pair")
+	}
+	return int(binary.BigEndian.Uint32(data[0:4]) & 0x7fffffff), data[4:], nil
+}
+
+func decode_fastcgi_params(data []byte) (map[string]string, error) {
+
+	params := make(map[string]string)
+
+	for len(data) > 0 {
+		name_length, rest, err := read_fastcgi_length(data)
+		if err != nil {
+			return nil, err
+		}
+		value_length, rest, err := read_fastcgi_length(rest)
+		if err != nil {
+			return nil, err
+		}
+		if len(rest) < name_length+value_length {
+			return nil, errors.New("truncated FastCGI name-value pair")
+		}
+		params[string(rest[:name_length])] = string(rest[name_length : name_length+value_length])
+		data = rest[name_length+value_length:]
+	}
+
+	return params, nil
+}
+
+func encode_fastcgi_params(params map[string]string) []byte {
+	var buf bytes.Buffer
+	for k, v := range params {
+		// Values returned by the responder are always short
+		buf.WriteByte(uint8(len(k)))
+		buf.WriteByte(uint8(len(v)))
+		buf.WriteString(k)
+		buf.WriteString(v)
+	}
+	return buf.Bytes()
+}
+
+// Reads records from the connection until a complete request (its params and stdin
+// streams) has arrived. Management records are answered along the way.
+// Returns the request ID, whether the web server wants the connection kept open, and
+// the request params.
+func read_fastcgi_request(reader *bufio.Reader, fd io.Writer) (uint16, bool, map[string]string, error) {
+
+	var request_id uint16
+	var keep_conn bool
+	var params_data bytes.Buffer
+	params_done := false
+	in_request := false
+
+	for {
+		rec, err := read_fastcgi_record(reader)
+		if err != nil {
+			return 0, false, nil, err
+		}
+
+		switch rec.rec_type {
+
+		case fcgi_get_values:
+			result := encode_fastcgi_params(map[string]string{"FCGI_MPXS_CONNS": "0"})
+			err = write_fastcgi_record(fd, fcgi_get_values_result, 0, result)
+
+		case fcgi_begin_request:
+			if len(rec.content) < 3 {
+				return 0, false, nil, errors.New("malformed FastCGI begin request record")
+			}
+			if in_request {
+				err = write_fastcgi_end_request(fd, rec.request_id, fcgi_cant_mpx_conn)
+				break
+			}
+			role := binary.BigEndian.Uint16(rec.content[0:2])
+			if role != fcgi_role_responder {
+				err = write_fastcgi_end_request(fd, rec.request_id, fcgi_unknown_role)
+				break
+			}
+			request_id = rec.request_id
+			keep_conn = rec.content[2]&fcgi_flag_keep_conn != 0
+			params_data.Reset()
+			params_done = false
+			in_request = true
+
+		case fcgi_abort_request:
+			if in_request && rec.request_id == request_id {
+				in_request = false
+				err = write_fastcgi_end_request(fd, request_id, fcgi_request_complete)
+				if err == nil && !keep_conn {
+					return 0, false, nil, io.EOF
+				}
+			}
+
+		case fcgi_params:
+			if !in_request || rec.request_id != request_id {
+				continue
+			}
+			if len(rec.content) == 0 {
+				params_done = true
+			} else {
+				params_data.Write(rec.content)
+			}
+
+		case fcgi_stdin:
+			if !in_request || rec.request_id != request_id {
+				continue
+			}
+			// Gemini requests have no body, so stdin is discarded. The request is
+			// complete once the (empty) stdin stream has been terminated.
+			if len(rec.content) == 0 {
+				if !params_done {
+					return 0, false, nil, errors.New("FastCGI stdin ended before params")
+				}
+				params, err := decode_fastcgi_params(params_data.Bytes())
+				return request_id, keep_conn, params, err
+			}
+
+		default:
+			var body [8]byte
+			body[0] = rec.rec_type
+			err = write_fastcgi_record(fd, fcgi_unknown_type, 0, body[:])
+		}
+
+		if err != nil {
+			return 0, false, nil, err
+		}
+	}
+}
+
+// fastcgi_writer collects a response and sends it on Close as the request's stdout
+// stream, followed by the end of the request.
+type fastcgi_writer struct {
+	fd         net.Conn
+	request_id uint16
+	buf        bytes.Buffer
+}
+
+func (w *fastcgi_writer) Read(p []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (w *fastcgi_writer) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+func (w *fastcgi_writer) Close() error {
+	if w.buf.Len() > 0 {
+		err := write_fastcgi_record(w.fd, fcgi_stdout, w.request_id, w.buf.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+	err := write_fastcgi_record(w.fd, fcgi_stdout, w.request_id, nil)
+	if err != nil {
+		return err
+	}
+	return write_fastcgi_end_request(w.fd, w.request_id, fcgi_request_complete)
+}
+
+func is_closed_conn_error(err error) bool {
+	return err == io.EOF || errors.Is(err, net.ErrClosed)
+}
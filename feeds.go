@@ -0,0 +1,102 @@
+package main
+
+import (
+	"database/sql"
+	"sort"
+)
+
+// The thread index and each thread can be followed as a feed, either as an Atom feed
+// or as a gemtext page that Gemini clients can subscribe to. Each entry in a feed is
+// a message in a thread: the thread index has the most recent new threads and
+// responses, and a thread's feed has its responses.
+
+// The number of entries in a feed
+const feed_size = 50
+
+type feed_item struct {
+	thr GemThreadThread
+	// msg.dt_created is when the message was added to the thread
+	msg       GemThreadMessage
+	is_origin bool
+}
+
+// The time that a thread last changed: when its latest response was added or, if it
+// has none, when it was created.
+func thread_updated(thr GemThreadThread) string {
+	if thr.dt_updated > thr.dt_created {
+		return thr.dt_updated
+	}
+	return thr.dt_created
+}
+
+// Returns the messages in a thread, newest first, up to feed_size of them. The message
+// that started the thread is included if with_origin is set.
+func thread_feed_items(db *sql.DB, thr GemThreadThread, with_origin bool) ([]feed_item, error) {
+
+	msgs, err := db_find_messages_for_thread(db, thr.id, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var items []feed_item
+
+	for i, msg := range msgs {
+		// The message that started the thread is last, and has an ID of zero if it
+		// has been removed
+		is_origin := i == len(msgs)-1
+		if msg.id == 0 || (is_origin && !with_origin) {
+			continue
+		}
+		if is_origin {
+			msg.dt_created = thr.dt_created
+		}
+		items = append(items, feed_item{thr, msg, is_origin})
+	}
+
+	if len(items) > feed_size {
+		items = items[:feed_size]
+	}
+
+	return items, nil
+}
+
+// Returns the newest threads and responses on the server, newest first, up to
+// feed_size of them.
+func recent_feed_items(db *sql.DB) ([]feed_item, error) {
+
+	// Threads without responses are not among the most recently updated, so the most
+	// recently created threads are added to them.
+	by_update, err := db_list_threads(db, 0, feed_size, false, false)
+	if err != nil {
+		return nil, err
+	}
+	by_creation, err := db_list_threads(db, 0, feed_size, false, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var items []feed_item
+	seen := make(map[int64]bool)
+
+	for _, thr := range append(by_update, by_creation...) {
+		if seen[thr.id] {
+			continue
+		}
+		seen[thr.id] = true
+
+		thr_items, err := thread_feed_items(db, thr, true)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, thr_items...)
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].msg.dt_created > items[j].msg.dt_created
+	})
+	if len(items) > feed_size {
+		items = items[:feed_size]
+	}
+
+	return items, nil
+}
@@ -1,30 +1,217 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"database/sql"
 	"errors"
+	"fmt"
 	"io"
+	"mime"
+	"net"
 	"net/url"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"git.sr.ht/~adnano/go-gemini"
+	"golang.org/x/text/encoding/htmlindex"
 )
 
-func do(req *gemini.Request, via []*gemini.Request) (*gemini.Response, error) {
-	client := gemini.Client{}
-	ctx := context.Background()
+// Networks that user-submitted URLs may not point into: loopback, link-local,
+// private, shared (carrier-grade NAT), unspecified and multicast addresses.
+var default_blocked_networks = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+}
+
+func parse_networks(cidrs []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func network_contains(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Refuses connections to blocked addresses. It is called by the dialer with the
+// address that is actually being connected to, after name resolution, so a host name
+// that resolves to an internal address is caught no matter how it was reached,
+// including through a redirect.
+func check_dial_address(network string, address string, c syscall.RawConn) error {
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return errors.New("refusing to connect to unresolved address " + host)
+	}
+
+	allowed, err := parse_networks(config().Fetcher.AllowedNetworks)
+	if err != nil {
+		return err
+	}
+
+	if network_contains(allowed, ip) {
+		return nil
+	}
+
+	blocked, err := parse_networks(append(default_blocked_networks, config().Fetcher.BlockedNetworks...))
+	if err != nil {
+		return err
+	}
+
+	if network_contains(blocked, ip) {
+		return errors.New("refusing to connect to " + host + ", which is a loopback, private or otherwise blocked address")
+	}
+
+	return nil
+}
+
+func new_client(db *sql.DB) *gemini.Client {
+	dialer := &net.Dialer{
+		Timeout: config().Fetcher.ConnectTimeout.Duration,
+		Control: check_dial_address,
+	}
+	return &gemini.Client{
+		DialContext:      dialer.DialContext,
+		TrustCertificate: known_host_verifier(db),
+	}
+}
+
+// A fetch_error is returned when the remote server does not reply with a page. The
+// status and meta are those of the server's reply; a status of zero means that no
+// reply was received, and err says why.
+type fetch_error struct {
+	status gemini.Status
+	meta   string
+	err    error
+}
+
+func (e fetch_error) Error() string {
+	if e.status == 0 {
+		return e.err.Error()
+	}
+	rstr := fmt.Sprintf("the remote server replied \"%d %s\"", e.status, e.meta)
+	if e.err != nil {
+		rstr += "; " + e.err.Error()
+	}
+	return rstr
+}
+
+func (e fetch_error) Unwrap() error {
+	return e.err
+}
+
+// Reports whether err means that the page was not found or that its server could not
+// be reached, as opposed to its server refusing the request for some other reason.
+func is_unreachable_error(err error) bool {
+
+	var fetch_err fetch_error
+	if !errors.As(err, &fetch_err) {
+		return false
+	}
+
+	if fetch_err.status == 0 {
+		var cert_err certificate_changed_error
+		return !errors.As(err, &cert_err)
+	}
+
+	return fetch_err.status == gemini.StatusNotFound
+}
+
+// Cancels a fetch after a timeout. Which timeout fired is remembered so that the
+// resulting error can say what took too long.
+type fetch_timer struct {
+	cancel    context.CancelFunc
+	timer     *time.Timer
+	timed_out int32
+}
+
+func start_fetch_timer(cancel context.CancelFunc, timeout time.Duration) *fetch_timer {
+	ft := &fetch_timer{cancel: cancel}
+	ft.timer = time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&ft.timed_out, 1)
+		ft.cancel()
+	})
+	return ft
+}
+
+// Stops the timer and reports whether it had already fired.
+func (ft *fetch_timer) stop() bool {
+	ft.timer.Stop()
+	return atomic.LoadInt32(&ft.timed_out) == 1
+}
+
+// Closes body once ctx is done. A response body only checks its context between
+// reads, so a capsule that stops sending would otherwise block the read for good;
+// closing the body makes the read fail. The returned function stops the watch.
+func close_when_done(ctx context.Context, body io.Closer) func() {
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			body.Close()
+		case <-stop:
+		}
+	}()
+	return func() { close(stop) }
+}
+
+func do(ctx context.Context, cancel context.CancelFunc, client *gemini.Client, req *gemini.Request, via []*gemini.Request) (*gemini.Response, error) {
+
+	err := check_robots(ctx, client, req.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	header_timer := start_fetch_timer(cancel, config().Fetcher.HeaderTimeout.Duration)
 	resp, err := client.Do(ctx, req)
+	if header_timer.stop() {
+		return nil, fetch_error{err: errors.New("timed out waiting for a response from " + req.URL.Host)}
+	}
 	if err != nil {
-		return resp, err
+		return resp, fetch_error{err: err}
 	}
 
 	switch resp.Status.Class() {
 
 	case gemini.StatusInput:
-		return resp, errors.New("remote host requires input -- not supported")
+		return resp, fetch_error{status: resp.Status, meta: resp.Meta, err: errors.New("pages that ask for input are not supported")}
 
 	case gemini.StatusRedirect:
 		via = append(via, req)
-		if len(via) > 5 {
+		if len(via) > config().Fetcher.MaxRedirects {
 			return resp, errors.New("too many redirects")
 		}
 
@@ -35,32 +222,170 @@ func do(req *gemini.Request, via []*gemini.Request) (*gemini.Response, error) {
 		target = req.URL.ResolveReference(target)
 		redirect := *req
 		redirect.URL = target
-		return do(&redirect, via)
+		resp.Body.Close()
+
+		// A redirect to another host is a fetch from that host, and counts against its
+		// limits; one to the same host is part of the fetch already counted.
+		if !strings.EqualFold(target.Hostname(), req.URL.Hostname()) {
+			err = reserve_host_fetch(target.Hostname())
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return do(ctx, cancel, client, &redirect, via)
 	}
 
 	return resp, err
 }
 
-func retrieve(addr string) (string, error) {
+// Reads at most max_body_size bytes of the response body. Larger bodies are either
+// truncated at the last complete line or rejected, depending on the configuration.
+func read_body(body io.Reader) ([]byte, error) {
+
+	max_size := config().Fetcher.MaxBodySize
+
+	response_body, err := io.ReadAll(io.LimitReader(body, max_size+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(response_body)) <= max_size {
+		return response_body, nil
+	}
+
+	if !config().Fetcher.TruncateLargeBodies {
+		return nil, fmt.Errorf("page is larger than the maximum of %d bytes", max_size)
+	}
+
+	response_body = response_body[:max_size]
+	if i := bytes.LastIndexByte(response_body, '\n'); i >= 0 {
+		response_body = response_body[:i+1]
+	}
+
+	return response_body, nil
+}
+
+// A fetched_page is a successfully retrieved page, with its body decoded to UTF-8.
+type fetched_page struct {
+	// The URL that was requested, before any redirects
+	url        string
+	media_type string
+	params     map[string]string
+	body       string
+}
+
+// Media types that gemthread knows how to extract a title and summary from
+var supported_media_types = map[string]bool{
+	"text/gemini":     true,
+	"text/plain":      true,
+	"text/markdown":   true,
+	"text/x-markdown": true,
+}
+
+// Parses the meta of a success response. An empty meta means text/gemini in UTF-8.
+func parse_media_type(meta string) (string, map[string]string, error) {
+
+	if len(strings.TrimSpace(meta)) == 0 {
+		meta = "text/gemini; charset=utf-8"
+	}
+
+	media_type, params, err := mime.ParseMediaType(meta)
+	if err != nil {
+		return "", nil, errors.New("invalid media type \"" + meta + "\": " + err.Error())
+	}
+
+	if !supported_media_types[media_type] {
+		return "", nil, errors.New("unsupported media type " + media_type + "; only text/gemini, text/plain and text/markdown pages may be added")
+	}
+
+	return media_type, params, nil
+}
+
+// Decodes body from the charset named in the media type parameters to UTF-8.
+// Text without a charset parameter is UTF-8 by definition in Gemini.
+func decode_body(body []byte, params map[string]string) (string, error) {
+
+	charset := strings.ToLower(strings.TrimSpace(params["charset"]))
+
+	if len(charset) == 0 || charset == "utf-8" || charset == "utf8" || charset == "us-ascii" {
+		return strings.ToValidUTF8(string(body), "\uFFFD"), nil
+	}
+
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return "", errors.New("unsupported charset " + charset)
+	}
+
+	decoded, err := enc.NewDecoder().Bytes(body)
+	if err != nil {
+		return "", errors.New("unable to decode page from " + charset + ": " + err.Error())
+	}
+
+	return string(decoded), nil
+}
+
+// Fetches the page at addr. The fetch is abandoned if ctx is cancelled, which happens
+// when the client that asked for it disconnects. If use_cache is set, a page fetched
+// within the refetch cooldown is served from the page cache. A fetch that would
+// exceed the target host's limits fails with a slow_down_error.
+func retrieve(ctx context.Context, db *sql.DB, addr string, use_cache bool) (fetched_page, error) {
+
+	if cached, ok := find_cached_page(addr); ok && use_cache {
+		return cached, nil
+	}
+
+	page := fetched_page{url: addr}
 
 	req, err := gemini.NewRequest(addr)
+	if err != nil {
+		return page, err
+	}
+
+	err = reserve_host_fetch(req.URL.Hostname())
+	if err != nil {
+		return page, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	resp, err := do(req, nil)
+	resp, err := do(ctx, cancel, new_client(db), req, nil)
 	if err != nil {
-		return "", err
+		if resp != nil {
+			resp.Body.Close()
+		}
+		return page, err
 	}
 	defer resp.Body.Close()
+	defer close_when_done(ctx, resp.Body)()
 
 	// Handle response
 	if resp.Status.Class() == gemini.StatusSuccess {
 
-		response_body, err := io.ReadAll(resp.Body)
+		page.media_type, page.params, err = parse_media_type(resp.Meta)
 		if err != nil {
-			return "", err
+			return page, err
 		}
-		return string(response_body), nil
+
+		body_timer := start_fetch_timer(cancel, config().Fetcher.BodyTimeout.Duration)
+		response_body, err := read_body(resp.Body)
+		if body_timer.stop() {
+			return page, fetch_error{err: errors.New("timed out reading the page from " + req.URL.Host)}
+		}
+		if err != nil {
+			return page, err
+		}
+
+		page.body, err = decode_body(response_body, page.params)
+		if err != nil {
+			return page, err
+		}
+
+		save_cached_page(page)
+		return page, nil
 	}
 
-	return "", errors.New("something went wrong")
+	return page, fetch_error{status: resp.Status, meta: resp.Meta}
 
 }
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseNetworks(t *testing.T) {
+
+	tests := []struct {
+		cidrs    []string
+		ip       string
+		contains bool
+		invalid  bool
+	}{
+		{[]string{"10.0.0.0/8"}, "10.1.2.3", true, false},
+		{[]string{" 10.0.0.0/8 "}, "10.1.2.3", true, false},
+		{[]string{"10.0.0.0/8"}, "11.1.2.3", false, false},
+		{[]string{"10.0.0.0/8", "fd00::/8"}, "fd12::1", true, false},
+		{[]string{"10.0.0.0/8"}, "::ffff:10.1.2.3", true, false},
+		{nil, "10.1.2.3", false, false},
+		{[]string{"10.0.0.0"}, "", false, true},
+		{[]string{"example.org/8"}, "", false, true},
+	}
+
+	for _, test := range tests {
+		networks, err := parse_networks(test.cidrs)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("parse_networks(%q): got no error, want one", test.cidrs)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parse_networks(%q): %s", test.cidrs, err.Error())
+			continue
+		}
+		got := network_contains(networks, net.ParseIP(test.ip))
+		if got != test.contains {
+			t.Errorf("parse_networks(%q) contains %s: got %t, want %t", test.cidrs, test.ip, got, test.contains)
+		}
+	}
+}
+
+func TestCheckDialAddress(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		address string
+		allowed []string
+		blocked []string
+		refused bool
+	}{
+		{"a public IPv4 address", "93.184.216.34:1965", nil, nil, false},
+		{"a public IPv6 address", "[2606:2800:220:1:248:1893:25c8:1946]:1965", nil, nil, false},
+		{"IPv4 loopback", "127.0.0.1:1965", nil, nil, true},
+		{"another IPv4 loopback address", "127.3.2.1:1965", nil, nil, true},
+		{"IPv6 loopback", "[::1]:1965", nil, nil, true},
+		{"IPv4-mapped IPv6 loopback", "[::ffff:127.0.0.1]:1965", nil, nil, true},
+		{"IPv4-mapped IPv6 private address", "[::ffff:192.168.1.1]:1965", nil, nil, true},
+		{"10/8", "10.0.0.1:1965", nil, nil, true},
+		{"172.16/12", "172.31.255.254:1965", nil, nil, true},
+		{"just outside 172.16/12", "172.32.0.1:1965", nil, nil, false},
+		{"192.168/16", "192.168.0.1:1965", nil, nil, true},
+		{"carrier-grade NAT", "100.64.0.1:1965", nil, nil, true},
+		{"IPv4 link-local", "169.254.169.254:1965", nil, nil, true},
+		{"IPv6 link-local", "[fe80::1]:1965", nil, nil, true},
+		{"IPv6 unique local", "[fd00::1]:1965", nil, nil, true},
+		{"unspecified", "0.0.0.0:1965", nil, nil, true},
+		{"multicast", "224.0.0.1:1965", nil, nil, true},
+		{"an allowed network overrides the blocked ones", "127.0.0.1:1965", []string{"127.0.0.0/8"}, nil, false},
+		{"an allowed network covers IPv4-mapped addresses", "[::ffff:127.0.0.1]:1965", []string{"127.0.0.0/8"}, nil, false},
+		{"an allowed network does not allow others", "10.0.0.1:1965", []string{"127.0.0.0/8"}, nil, true},
+		{"a configured blocked network", "93.184.216.34:1965", nil, []string{"93.184.216.0/24"}, true},
+		{"an unresolved host name", "example.org:1965", nil, nil, true},
+		{"an address without a port", "93.184.216.34", nil, nil, true},
+		{"an invalid allowed network", "93.184.216.34:1965", []string{"nonsense"}, nil, true},
+	}
+
+	for _, test := range tests {
+		cfg := default_config()
+		cfg.Fetcher.AllowedNetworks = test.allowed
+		cfg.Fetcher.BlockedNetworks = test.blocked
+		set_config(cfg, nil)
+
+		err := check_dial_address("tcp", test.address, nil)
+		if test.refused && err == nil {
+			t.Errorf("%s: %s was allowed, want it refused", test.name, test.address)
+		}
+		if !test.refused && err != nil {
+			t.Errorf("%s: %s was refused (%s), want it allowed", test.name, test.address, err.Error())
+		}
+	}
+}
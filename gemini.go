@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"git.sr.ht/~adnano/go-gemini"
+)
+
+// How long a Gemini client has to send its request line once connected
+const gemini_request_timeout = 30 * time.Second
+
+func listen_gemini() (net.Listener, error) {
+
+	if len(listen_address()) == 0 {
+		return nil, errors.New("invalid listen address: " + listen_address())
+	}
+
+	cert, err := tls.LoadX509KeyPair(certificate_path(), key_path())
+	if err != nil {
+		return nil, errors.New("error loading certificate: " + err.Error())
+	}
+
+	tls_config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		// Client certificates are self-signed in Gemini-space, so request
+		// them without attempting to verify them.
+		ClientAuth: tls.RequestClientCert,
+	}
+
+	return tls.Listen("tcp", listen_address(), tls_config)
+}
+
+// Reads a Gemini request line from the connection. The request's path_info is relative
+// to the gemthread server URL, as it would be in the SCGI PATH_INFO header.
+func read_gemini_request(fd net.Conn) (gemthread_request, error) {
+
+	var gem_req gemthread_request
+
+	fd.SetReadDeadline(time.Now().Add(gemini_request_timeout))
+	defer fd.SetReadDeadline(time.Time{})
+
+	req, err := gemini.ReadRequest(fd)
+	if err != nil {
+		return gem_req, errors.New("error reading request: " + err.Error())
+	}
+
+	if req.URL.Scheme != "gemini" {
+		return gem_req, errors.New("only gemini:// requests are supported")
+	}
+
+	base_url, err := url.Parse(server_url())
+	if err != nil {
+		return gem_req, err
+	}
+
+	path := req.URL.Path
+	if !strings.HasPrefix(path, base_url.Path) {
+		return gem_req, errors.New("request is outside of " + server_url())
+	}
+	path_info := strings.TrimPrefix(path, base_url.Path)
+	if len(path_info) > 0 && !strings.HasPrefix(path_info, "/") {
+		return gem_req, errors.New("request is outside of " + server_url())
+	}
+
+	remote_addr, _, err := net.SplitHostPort(fd.RemoteAddr().String())
+	if err != nil {
+		remote_addr = fd.RemoteAddr().String()
+	}
+
+	params := map[string]string{
+		"GEMINI_URL":   req.URL.String(),
+		"PATH_INFO":    path_info,
+		"QUERY_STRING": req.URL.RawQuery,
+		"REMOTE_ADDR":  remote_addr,
+		"SERVER_NAME":  req.URL.Hostname(),
+	}
+
+	// Identify clients by their certificates as Molly Brown does
+	if tls_conn, ok := fd.(*tls.Conn); ok {
+		peer_certs := tls_conn.ConnectionState().PeerCertificates
+		if len(peer_certs) > 0 {
+			params["TLS_CLIENT_HASH"] = certificate_fingerprint(peer_certs[0])
+		}
+	}
+
+	return request_from_params(params), nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Gemtext versions of the feeds in the Gemini subscription ("gemsub") format, which
+// many Gemini clients can subscribe to: the page's level one heading names the feed,
+// and each entry is a link line whose text starts with the entry's date in
+// YYYY-MM-DD form. Clients tell entries apart by their URLs, so each entry links to
+// the message's own page.
+
+func (item feed_item) GemsubString() string {
+
+	date := item.msg.dt_created
+	if len(date) > len("2006-01-02") {
+		date = date[:len("2006-01-02")]
+	}
+
+	title := item.msg.title
+	if !item.is_origin {
+		title = "Re: " + item.thr.title + " — " + item.msg.title
+	}
+
+	return "=> " + item.msg.url + " " + date + " " + item.msg.author + " — " + title + "\r\n"
+}
+
+// Returns the entry lines for items, leaving out any whose page is already listed.
+func gemsub_entries(items []feed_item) string {
+
+	rstr := ""
+	seen := make(map[string]bool)
+
+	for _, item := range items {
+		if seen[item.msg.url] {
+			continue
+		}
+		seen[item.msg.url] = true
+		rstr += item.GemsubString()
+	}
+
+	return rstr
+}
+
+// Returns the subscription page of new threads and the latest responses to them.
+func threads_subscribe_page(db *sql.DB) (string, error) {
+
+	items, err := recent_feed_items(db)
+	if err != nil {
+		return "", err
+	}
+
+	rstr := "# GemThread threads\r\n"
+	rstr += "## New threads and responses on this GemThread server\r\n\r\n"
+	rstr += gemsub_entries(items)
+	rstr += "\r\n"
+	rstr += fmt.Sprintf("=> %s/threads See all threads\r\n", server_url())
+
+	return rstr, nil
+}
+
+// Returns the subscription page of responses to a thread.
+func thread_subscribe_page(db *sql.DB, thr GemThreadThread) (string, error) {
+
+	items, err := thread_feed_items(db, thr, false)
+	if err != nil {
+		return "", err
+	}
+
+	rstr := fmt.Sprintf("# %s — %s\r\n", thr.author, thr.title)
+	rstr += "## Responses to this thread\r\n\r\n"
+	rstr += gemsub_entries(items)
+	rstr += "\r\n"
+	rstr += fmt.Sprintf("=> %s/threads/%d Return to the thread\r\n", server_url(), thr.id)
+
+	return rstr, nil
+}
@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"fmt"
 	"net/url"
+	"strings"
 )
 
 type GemThreadMessage struct {
@@ -13,6 +14,10 @@ type GemThreadMessage struct {
 	title      string
 	dt_created string
 	summary    string
+	// Set by "GemThread.RequireBacklinks" on the page; not stored with the message
+	require_backlinks bool
+	// Set by "GemThread.ReplyTo" on the page; not stored with the message
+	reply_to string
 }
 
 func (msg GemThreadMessage) String() string {
@@ -25,6 +30,22 @@ func (msg GemThreadMessage) String() string {
 	return rstr
 }
 
+// Returns the message as it is shown in a reply tree, marked with its depth in the
+// tree. Responses to the thread itself have a depth of zero.
+func (msg GemThreadMessage) TreeString(depth int) string {
+	if depth == 0 {
+		return msg.String()
+	}
+	indent := strings.Repeat("· ", depth-1) + "↳ "
+	rstr := "=> " + msg.url + " " + indent + msg.author + " — " + msg.title + "\r\n"
+	rstr += strings.Repeat("· ", depth) + msg.dt_created
+	if len(msg.summary) > 0 {
+		rstr += " - " + msg.summary
+	}
+	rstr += "\r\n"
+	return rstr
+}
+
 func (msg GemThreadMessage) FullString() string {
 	rstr := fmt.Sprintf("Message %d\r\n", msg.id)
 	rstr += "=> " + server_url() + fmt.Sprintf("/messages/%d MessageID: %d\r\n", msg.id, msg.id)
@@ -50,6 +71,19 @@ func (msg GemThreadMessage) InstancesString(db *sql.DB) string {
 	str += fmt.Sprintf("=> %s/messages/%d MessageID: %d\r\n", server_url(), msg.id, msg.id)
 	str += msg.TextString()
 	str += fmt.Sprintf("=> %s/messages/%d/update?%s Refetch and update this message\r\n", server_url(), msg.id, url.QueryEscape(msg.url))
+	str += fmt.Sprintf("=> %s/messages/%d/history History of changes to this message\r\n", server_url(), msg.id)
+	snap, err := db_find_snapshot(db, msg.id)
+	if err != nil {
+		str += fmt.Sprintf("Error when looking for an archived copy of this message: %s\r\n", err.Error())
+	} else if snap.messages_id > 0 {
+		str += fmt.Sprintf("=> %s/messages/%d/archive Archived copy of this message, saved %s\r\n", server_url(), msg.id, snap.dt_fetched)
+	}
+	check, err := db_find_message_check(db, msg.id)
+	if err != nil {
+		str += fmt.Sprintf("Error when looking up when this message was last checked: %s\r\n", err.Error())
+	} else {
+		str += check.String() + "\r\n"
+	}
 	thr_init, err := db_find_thread_by_originating_message_id(db, msg.id)
 	if err != nil {
 		str += fmt.Sprintf("Error when searching for a thread originated by this message: %s\r\n", err.Error())
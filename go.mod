@@ -7,3 +7,5 @@ require github.com/BurntSushi/toml v0.3.1
 require github.com/mattn/go-sqlite3 v1.14.7
 
 require git.sr.ht/~adnano/go-gemini v0.2.1
+
+require golang.org/x/text v0.3.3
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Politeness limits for the capsules that gemthread fetches from. Every fetch made by
+// retrieve(), including each redirect to another host and each fetch of a robots.txt,
+// draws from a token bucket for the target host, and consecutive fetches from a host
+// are at least min_host_interval apart. A page fetched again within the refetch_cooldown is served
+// from the page cache instead of being fetched, except when its author asks for it
+// to be updated.
+
+// A slow_down_error is returned when a fetch or submission would exceed a limit. The
+// request should be retried after the wait.
+type slow_down_error struct {
+	reason string
+	wait   time.Duration
+}
+
+func (e slow_down_error) Error() string {
+	return fmt.Sprintf("%s; try again in %d seconds", e.reason, e.wait_seconds())
+}
+
+// The wait, rounded up to whole seconds, as used in a Gemini 44 SLOW DOWN response
+func (e slow_down_error) wait_seconds() int {
+	return int((e.wait + time.Second - 1) / time.Second)
+}
+
+type host_bucket struct {
+	tokens     float64
+	dt_updated time.Time
+	dt_fetched time.Time
+}
+
+type cached_page struct {
+	page       fetched_page
+	dt_fetched time.Time
+}
+
+var _host_buckets = make(map[string]*host_bucket)
+var _page_cache = make(map[string]cached_page)
+var _page_cache_bytes int
+var _host_limits_lock sync.Mutex
+
+// Entries older than this are dropped once the maps grow large
+const host_limits_idle_time = time.Hour
+const host_limits_prune_size = 1024
+
+// The most pages, and the most bytes of page text, that the page cache holds. The
+// oldest pages are dropped to make room for new ones.
+const page_cache_max_entries = 256
+const page_cache_max_bytes = 16 * 1024 * 1024
+
+// Returns the cached copy of a page fetched within the refetch cooldown, if any.
+func find_cached_page(addr string) (fetched_page, bool) {
+
+	_host_limits_lock.Lock()
+	defer _host_limits_lock.Unlock()
+
+	cached, ok := _page_cache[addr]
+	if !ok || time.Since(cached.dt_fetched) > config().Fetcher.RefetchCooldown.Duration {
+		return fetched_page{}, false
+	}
+
+	return cached.page, true
+}
+
+func save_cached_page(page fetched_page) {
+
+	_host_limits_lock.Lock()
+	defer _host_limits_lock.Unlock()
+
+	now := time.Now()
+
+	delete_cached_page(page.url)
+
+	for k, v := range _page_cache {
+		if now.Sub(v.dt_fetched) > config().Fetcher.RefetchCooldown.Duration {
+			delete_cached_page(k)
+		}
+	}
+
+	if len(page.body) > page_cache_max_bytes {
+		return
+	}
+
+	for len(_page_cache) >= page_cache_max_entries || _page_cache_bytes+len(page.body) > page_cache_max_bytes {
+		oldest := ""
+		for k, v := range _page_cache {
+			if len(oldest) == 0 || v.dt_fetched.Before(_page_cache[oldest].dt_fetched) {
+				oldest = k
+			}
+		}
+		delete_cached_page(oldest)
+	}
+
+	_page_cache[page.url] = cached_page{page: page, dt_fetched: now}
+	_page_cache_bytes += len(page.body)
+}
+
+// Removes a page from the page cache. The caller holds _host_limits_lock.
+func delete_cached_page(addr string) {
+	if cached, ok := _page_cache[addr]; ok {
+		_page_cache_bytes -= len(cached.page.body)
+		delete(_page_cache, addr)
+	}
+}
+
+// Returns the host's bucket, refilled for the time since it was last used. The caller
+// holds _host_limits_lock.
+func find_host_bucket(host string, now time.Time) *host_bucket {
+
+	cfg := config().Fetcher
+
+	rate := float64(cfg.HostFetchesPerMinute) / 60.0
+	burst := float64(cfg.HostBurst)
+
+	if len(_host_buckets) >= host_limits_prune_size {
+		for k, v := range _host_buckets {
+			if now.Sub(v.dt_updated) > host_limits_idle_time {
+				delete(_host_buckets, k)
+			}
+		}
+	}
+
+	bucket, ok := _host_buckets[host]
+	if !ok {
+		bucket = &host_bucket{tokens: burst, dt_updated: now}
+		_host_buckets[host] = bucket
+	}
+
+	bucket.tokens += now.Sub(bucket.dt_updated).Seconds() * rate
+	if bucket.tokens > burst {
+		bucket.tokens = burst
+	}
+	bucket.dt_updated = now
+
+	return bucket
+}
+
+// Takes a token from the host's bucket, or returns a slow_down_error saying how long
+// to wait if none is available or the host was fetched from too recently.
+func reserve_host_fetch(host string) error {
+
+	cfg := config().Fetcher
+
+	host = strings.ToLower(host)
+	rate := float64(cfg.HostFetchesPerMinute) / 60.0
+	now := time.Now()
+
+	_host_limits_lock.Lock()
+	defer _host_limits_lock.Unlock()
+
+	bucket := find_host_bucket(host, now)
+
+	if since := now.Sub(bucket.dt_fetched); since < cfg.MinHostInterval.Duration {
+		return slow_down_error{reason: "too many recent requests to " + host, wait: cfg.MinHostInterval.Duration - since}
+	}
+
+	if rate > 0 && bucket.tokens < 1 {
+		wait := time.Duration((1 - bucket.tokens) / rate * float64(time.Second))
+		return slow_down_error{reason: "too many recent requests to " + host, wait: wait}
+	}
+
+	if rate > 0 {
+		bucket.tokens -= 1
+	}
+	bucket.dt_fetched = now
+
+	return nil
+}
+
+// Takes a token from the host's bucket for a fetch made on behalf of one that
+// reserve_host_fetch has already allowed, such as of the host's robots.txt. The fetch
+// is never refused, as the page it is for could then never be fetched from a host
+// whose burst is one, but the bucket can go below zero so that later fetches from the
+// host wait for it.
+func charge_host_fetch(host string) {
+
+	now := time.Now()
+
+	_host_limits_lock.Lock()
+	defer _host_limits_lock.Unlock()
+
+	bucket := find_host_bucket(strings.ToLower(host), now)
+	if config().Fetcher.HostFetchesPerMinute > 0 {
+		bucket.tokens -= 1
+	}
+	bucket.dt_fetched = now
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Foreign keys remove a message's responses, origination, checks, snapshot and
+// revisions along with it, and a thread's responses, policy and submission links
+// along with the thread. A thread whose first post has been removed is kept, along
+// with its other responses.
+//
+// Databases written before the foreign keys were enforced can still hold rows that
+// refer to messages or threads that no longer exist. These are the only rows that
+// are removed when the database is checked, which happens when the server starts and
+// when it is migrated with -migrate-only. -migrate-only -dry-run lists them instead.
+
+// Removes the rows that refer to missing rows and logs how many were removed from
+// each table.
+func repair_database(db *sql.DB) error {
+
+	dangling, err := db_delete_dangling_rows(db)
+	if err != nil {
+		return err
+	}
+
+	counts := make(map[string]int)
+	var tables []string
+	for _, row := range dangling {
+		if counts[row.table] == 0 {
+			tables = append(tables, row.table)
+		}
+		counts[row.table]++
+	}
+
+	for _, table := range tables {
+		fmt.Printf("Database integrity check: removed %d rows from %s that referred to missing rows\n", counts[table], table)
+	}
+
+	return nil
+}
+
+// Lists the rows that repair_database would remove, without removing them.
+func print_dangling_rows(db *sql.DB) error {
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	dangling, err := db_find_dangling_rows(tx)
+	if err != nil {
+		return err
+	}
+
+	if len(dangling) == 0 {
+		fmt.Println("No rows refer to missing rows.")
+	}
+	for _, row := range dangling {
+		fmt.Printf("Would remove row %d from %s, which refers to a missing row in %s\n", row.rowid, row.table, row.parent)
+	}
+
+	return nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDeleteOpeningPost(t *testing.T) {
+
+	cfg := default_config()
+	cfg.ServerURL = "gemini://gemthread.example/gemthread"
+	set_config(cfg, nil)
+
+	db, err := db_open(filepath.Join(t.TempDir(), "gemthread.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	thr_id, err := db_create_new_thread(db, GemThreadMessage{url: "gemini://a.example/post.gmi", author: "a", title: "post"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	origin, err := db_find_originating_message_for_thread(db, thr_id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first_id, err := db_insert_response_message(db, thr_id, GemThreadMessage{url: "gemini://b.example/first.gmi", author: "b", title: "first"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second_id, err := db_insert_response_message(db, thr_id, GemThreadMessage{url: "gemini://c.example/second.gmi", author: "c", title: "second"}, first_id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db_delete_message(db, origin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	thr, err := db_find_thread_by_id(db, thr_id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if thr.id != thr_id {
+		t.Fatalf("thread %d was removed along with the post that started it", thr_id)
+	}
+
+	msgs, err := db_find_messages_for_thread(db, thr_id, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []int64
+	for _, msg := range msgs {
+		ids = append(ids, msg.id)
+	}
+	if len(ids) != 3 || ids[0] != 0 || ids[1] != first_id || ids[2] != second_id {
+		t.Errorf("messages in thread: got IDs %v, want [0 %d %d]", ids, first_id, second_id)
+	}
+
+	items, err := thread_feed_items(db, thr, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 {
+		t.Errorf("feed items: got %d, want 2", len(items))
+	}
+	for _, item := range items {
+		if item.is_origin || item.msg.id == 0 {
+			t.Errorf("feed items: got the removed post that started the thread")
+		}
+	}
+
+	err = db_save_thread_policy(db, thr_id, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = check_backlink(db, thr_id, "text/gemini", []string{fmt.Sprintf("%s/threads/%d", server_url(), thr_id)})
+	if err != nil {
+		t.Errorf("backlink to the thread: got %q, want no error", err.Error())
+	}
+	err = check_backlink(db, thr_id, "text/gemini", []string{origin.url})
+	var rejected rejected_error
+	if !errors.As(err, &rejected) {
+		t.Errorf("backlink to the removed post: got %v, want a rejected_error", err)
+	} else if strings.Contains(rejected.message, origin.url) {
+		t.Errorf("backlink to the removed post: rejection %q suggests linking to the removed post", rejected.message)
+	}
+
+	// Replies to a removed response reply to the thread itself
+	first, err := db_find_message_by_id(db, first_id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db_delete_message(db, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parents, err := db_find_reply_parents_for_thread(db, thr_id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parents[second_id] != 0 {
+		t.Errorf("parent of the reply to a removed response: got %d, want 0", parents[second_id])
+	}
+}
+
+func TestRepairDatabase(t *testing.T) {
+
+	cfg := default_config()
+	cfg.ServerURL = "gemini://gemthread.example/gemthread"
+	set_config(cfg, nil)
+
+	path := filepath.Join(t.TempDir(), "gemthread.db")
+	db, err := db_open(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	thr_id, err := db_create_new_thread(db, GemThreadMessage{url: "gemini://a.example/post.gmi", author: "a", title: "post"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	origin, err := db_find_originating_message_for_thread(db, thr_id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp_id, err := db_insert_response_message(db, thr_id, GemThreadMessage{url: "gemini://b.example/resp.gmi", author: "b", title: "resp"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db_delete_message(db, origin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A response to a thread that does not exist, as older versions could leave
+	unchecked, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = unchecked.Exec("insert into responses(threads_id, messages_id, dt_created) values(?, ?, '')", thr_id+100, resp_id)
+	unchecked.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dangling, err := db_delete_dangling_rows(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dangling) != 1 || dangling[0].table != "responses" {
+		t.Errorf("dangling rows: got %v, want one row from responses", dangling)
+	}
+
+	thr, err := db_find_thread_by_id(db, thr_id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if thr.id != thr_id {
+		t.Errorf("thread %d without the post that started it was removed", thr_id)
+	}
+	msg, err := db_find_message_by_id(db, resp_id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.id != resp_id {
+		t.Errorf("response %d was removed", resp_id)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Trust on first use (TOFU) for the capsules that gemthread fetches from. The first
+// certificate seen for a host is recorded in the known_hosts table. A different
+// certificate seen later is recorded in known_host_changes for an administrator to
+// review, and depending on the fetcher's tofu_policy, the fetch is either refused
+// ("reject") or allowed to proceed ("flag").
+//
+// Gemini certificates are usually self-signed and are replaced when they expire, so
+// a new certificate is accepted without review once the recorded one has expired.
+
+// A certificate_changed_error is returned when a host presents a certificate other
+// than the one recorded for it, and the change has not been approved.
+type certificate_changed_error struct {
+	hostname string
+}
+
+func (e certificate_changed_error) Error() string {
+	return "the certificate for " + e.hostname + " has changed since it was first seen, and the change must be approved by the administrator of this GemThread server"
+}
+
+type GemThreadKnownHost struct {
+	hostname    string
+	fingerprint string
+	not_after   string
+	dt_created  string
+	dt_updated  string
+}
+
+func (host GemThreadKnownHost) String() string {
+	return fmt.Sprintf("%s SHA256:%s (expires %s, first seen %s)", host.hostname, host.fingerprint, host.not_after, host.dt_created)
+}
+
+func certificate_fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// Returns a function suitable for gemini.Client.TrustCertificate that checks
+// certificates against the known hosts in db.
+func known_host_verifier(db *sql.DB) func(hostname string, cert *x509.Certificate) error {
+	return func(hostname string, cert *x509.Certificate) error {
+		return verify_known_host(db, hostname, cert)
+	}
+}
+
+func verify_known_host(db *sql.DB, hostname string, cert *x509.Certificate) error {
+
+	policy := config().Fetcher.TofuPolicy
+	if policy == "off" {
+		return nil
+	}
+
+	seen := GemThreadKnownHost{
+		hostname:    hostname,
+		fingerprint: certificate_fingerprint(cert),
+		not_after:   cert.NotAfter.UTC().Format("2006-01-02 15:04:05Z"),
+	}
+
+	known, err := db_find_known_host(db, hostname)
+	if err != nil {
+		return errors.New("unable to look up known host " + hostname + ": " + err.Error())
+	}
+
+	if len(known.hostname) == 0 {
+		return db_save_known_host(db, seen)
+	}
+
+	if known.fingerprint == seen.fingerprint {
+		return nil
+	}
+
+	known_expiry, err := time.Parse("2006-01-02 15:04:05Z", known.not_after)
+	if err == nil && time.Now().After(known_expiry) {
+		return db_save_known_host(db, seen)
+	}
+
+	err = db_insert_known_host_change(db, seen)
+	if err != nil {
+		return errors.New("unable to record certificate change for " + hostname + ": " + err.Error())
+	}
+
+	if policy == "flag" {
+		fmt.Printf("Certificate for %s has changed and has been flagged for review\n", hostname)
+		return nil
+	}
+
+	return certificate_changed_error{hostname: hostname}
+}
+
+// Prints the certificate changes awaiting review, for the -host-changes flag.
+func print_known_host_changes(db *sql.DB) error {
+
+	changes, err := db_list_known_host_changes(db)
+	if err != nil {
+		return err
+	}
+
+	if len(changes) == 0 {
+		fmt.Println("No certificate changes are awaiting review.")
+		return nil
+	}
+
+	for _, change := range changes {
+		known, err := db_find_known_host(db, change.hostname)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Known: %s\n", known.String())
+		fmt.Printf("  Now: %s\n", change.String())
+	}
+
+	return nil
+}
@@ -1,148 +1,243 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"net"
 	"os"
 	"os/signal"
-	"strings"
+	"sync"
 	"syscall"
+	"time"
 )
 
-var _server_url string
-
-func server_url() string {
-	return _server_url
-}
-
-var _help_path string
-
-func help_path() string {
-	return _help_path
-}
-
-var _database_path string
-
-func database_path() string {
-	return _database_path
-}
-
-var _socket_path string
-
-func socket_path() string {
-	return _socket_path
-}
-
 func main() {
 
 	var l net.Listener
 	var err error
-	should_exit := false
 
 	_config_path := "gemthread.cfg"
 
+	// CGI servers generally cannot pass command line flags
+	if env_config_path := os.Getenv("GEMTHREAD_CONFIG"); len(env_config_path) > 0 {
+		_config_path = env_config_path
+	}
+
 	flag.StringVar(&_config_path,
 		"config",
 		_config_path,
 		"path to gemthread configuration file")
 
+	var list_host_changes bool
+	var trust_host string
+
+	flag.BoolVar(&list_host_changes,
+		"host-changes",
+		false,
+		"list capsule certificate changes awaiting review and exit")
+
+	flag.StringVar(&trust_host,
+		"trust-host",
+		"",
+		"accept the changed certificate awaiting review for a host and exit")
+
+	var migrate_only bool
+	var dry_run bool
+
+	flag.BoolVar(&migrate_only,
+		"migrate-only",
+		false,
+		"apply any pending database migrations and exit")
+
+	flag.BoolVar(&dry_run,
+		"dry-run",
+		false,
+		"with -migrate-only, list the pending database migrations without applying them")
+
 	flag.Parse()
 
-	_server_url = ""
-	_database_path = "gemthread.db"
-	_help_path = "help.gmi"
-	_socket_path = "gemthread.sock"
+	// Standard output may be a CGI response, which these errors must not be written
+	// into, as CGI mode is not known until the configuration has been read
+	cfg, err := load_config(_config_path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to continue due to configuration error: %s\n", err.Error())
+		os.Exit(1)
+	}
 
-	config_data, err := ioutil.ReadFile(_config_path)
+	help, err := load_help_template(cfg.Templates.HelpPath)
 	if err != nil {
-		fmt.Printf("Error reading %s: %s\n", _config_path, err.Error())
-		return
+		fmt.Fprintf(os.Stderr, "Unable to load help file: %s\n", err.Error())
+		os.Exit(1)
 	}
 
-	config_lines := strings.Split(string(config_data), "\n")
+	set_config(cfg, help)
 
-	for _, line := range config_lines {
-		line = strings.TrimSpace(line)
-		if len(line) == 0 || strings.HasPrefix(line, "#") {
-			continue
+	if migrate_only || dry_run {
+		err = print_migrations(database_path(), dry_run)
+		if err != nil {
+			fmt.Printf("Database error: %s\n", err.Error())
+			os.Exit(1)
 		}
-		parts := strings.SplitN(line, ":", 2)
-		if len(parts) != 2 {
-			fmt.Printf("Invalid configuration line: %s\n", line)
-			continue
+		if dry_run {
+			return
 		}
-		switch strings.ToUpper(strings.TrimSpace(parts[0])) {
-		case "SERVER_URL":
-			_server_url = strings.TrimSuffix(strings.TrimSpace(parts[1]), "/")
-		case "HELP_PATH":
-			_help_path = strings.TrimSpace(parts[1])
-		case "DATABASE_PATH":
-			_database_path = strings.TrimSpace(parts[1])
-		case "SOCKET_PATH":
-			_socket_path = strings.TrimSpace(parts[1])
-		default:
-			fmt.Printf("Invalid configuration line: %s\n", line)
+		db, err := db_open(database_path(), false)
+		if err == nil {
+			err = repair_database(db)
+			db.Close()
+		}
+		if err != nil {
+			fmt.Printf("Database error: %s\n", err.Error())
+			os.Exit(1)
 		}
-	}
-
-	if len(_server_url) == 0 || !strings.HasPrefix(_server_url, "gemini://") {
-		fmt.Printf("Unable to continue due to invalid gemthread URL: %s\n", _server_url)
 		return
 	}
 
-	if len(_help_path) == 0 {
-		fmt.Printf("Unable to continue due to invalid help file path: %s\n", _help_path)
+	if list_host_changes || len(trust_host) > 0 {
+		db, err := db_open(database_path(), false)
+		if err != nil {
+			fmt.Printf("Database error: %s\n", err.Error())
+			return
+		}
+		defer db.Close()
+		if list_host_changes {
+			err = print_known_host_changes(db)
+		} else {
+			err = db_approve_known_host_change(db, trust_host)
+			if err == nil {
+				fmt.Printf("The new certificate for %s is now trusted.\n", trust_host)
+			}
+		}
+		if err != nil {
+			fmt.Println(err.Error())
+		}
 		return
 	}
 
-	if len(_database_path) == 0 {
-		fmt.Printf("Unable to continue due to invalid database path: %s\n", _database_path)
+	if listen_mode() == "cgi" || is_cgi_environment() {
+		// One request per process: no listener and no signal handling are needed.
+		// Standard output is the response, so anything logged goes to standard error.
+		response := os.Stdout
+		os.Stdout = os.Stderr
+		db, err := db_open(database_path(), false)
+		if err != nil {
+			write_response(response, 42, "database error: "+err.Error())
+			return
+		}
+		defer db.Close()
+		handle_cgi_request(context.Background(), db, response)
+		// There are no queue workers in CGI mode, so once the response has been sent,
+		// run the submissions that are due before exiting.
+		response.Close()
+		run_submissions_once(context.Background(), db)
 		return
 	}
 
-	if len(_socket_path) == 0 {
-		fmt.Printf("Unable to continue due to invalid socket path: %s\n", _socket_path)
-		return
-	}
+	t := transports[listen_mode()]
 
-	// Molly Brown only supports UNIX sockets
-	l, err = net.Listen("unix", socket_path())
+	l, err = t.listen()
 
 	if err != nil {
-		fmt.Println("SCGI listen error", err.Error())
+		fmt.Printf("Unable to listen in %s mode: %s\n", listen_mode(), err.Error())
 		return
 	}
 
-	defer l.Close()
+	shutdown := make(chan struct{})
 
-	c := make(chan os.Signal)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
 	go func() {
-		<-c
-		fmt.Println("Received interrupt. Exiting.")
-		should_exit = true
-		l.Close()
+		for sig := range c {
+			if sig == syscall.SIGHUP {
+				err := reload_config(_config_path)
+				if err != nil {
+					fmt.Printf("Configuration reload failed, keeping the running configuration: %s\n", err.Error())
+				} else {
+					fmt.Println("Configuration reloaded.")
+				}
+				continue
+			}
+			fmt.Println("Received interrupt. Shutting down.")
+			close(shutdown)
+			l.Close()
+			return
+		}
 	}()
 
 	db, err := db_open(database_path(), false)
 	if err != nil {
 		fmt.Printf("Database error: %s\n", err.Error())
+		l.Close()
+		remove_socket(t)
 		return
 	}
 
-	defer db.Close()
+	err = repair_database(db)
+	if err != nil {
+		fmt.Printf("Database error: %s\n", err.Error())
+		db.Close()
+		l.Close()
+		remove_socket(t)
+		return
+	}
+
+	// Cancelled if in-flight requests are still running when the shutdown timeout expires
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Queue workers and the refresher count as in-flight requests, so that they too can
+	// finish what they are working on before the server exits.
+	var in_flight sync.WaitGroup
+
+	start_submission_workers(ctx, db, shutdown, &in_flight)
+	start_refresher(ctx, db, shutdown, &in_flight)
 
+accept_loop:
 	for {
 		fd, err := l.Accept()
 		if err != nil {
-			if should_exit {
-				return
+			select {
+			case <-shutdown:
+				break accept_loop
+			default:
 			}
-			fmt.Println("SCGI accept error", err.Error())
+			fmt.Println("Accept error", err.Error())
 			continue
 		}
-		go handle_request(fd, db)
+		in_flight.Add(1)
+		go func() {
+			defer in_flight.Done()
+			t.serve_conn(ctx, fd, db)
+		}()
 	}
+
+	// Give requests that are already being handled a chance to finish before the
+	// database is closed out from under them.
+	drained := make(chan struct{})
+	go func() {
+		in_flight.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-time.After(config().Listener.ShutdownTimeout.Duration):
+		fmt.Println("Timed out waiting for in-flight requests to finish. Cancelling them.")
+		cancel()
+		// Cancelled fetches return promptly; allow their handlers a moment to respond.
+		select {
+		case <-drained:
+		case <-time.After(time.Second):
+		}
+	}
+
+	err = db.Close()
+	if err != nil {
+		fmt.Printf("Error closing database: %s\n", err.Error())
+	}
+
+	remove_socket(t)
+
+	fmt.Println("Exiting.")
 }
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// The database schema is only ever changed by the migrations below. They are applied
+// in order when the database is opened, each in its own transaction, and each one
+// that has been applied is recorded in the schema_version table. A database whose
+// version is higher than the last migration here was written by a newer gemthread,
+// and is not opened.
+//
+// A released migration is never changed; to change the schema, add a migration to
+// the end of the list. The migrations up to version 10 use "if not exists" and
+// db_add_column_if_missing, because databases created before versions were recorded
+// already have some of their tables.
+
+type db_migration struct {
+	version     int
+	description string
+	apply       func(tx *sql.Tx) error
+}
+
+// Returns a migration step that runs the given statements.
+func migration_statements(statements string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(statements)
+		return err
+	}
+}
+
+// Returns a migration step that adds a column to a table unless it already has it.
+func migration_add_column(table string, column string, definition string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		return db_add_column_if_missing(tx, table, column, definition)
+	}
+}
+
+var db_migrations = []db_migration{
+	{1, "create the threads, messages, responses and originations tables", migration_statements(`
+	create table if not exists threads (
+		id integer not null primary key,
+		author text not null,
+		title text not null,
+		dt_created text not null,
+		dt_updated text not null
+	);
+	create table if not exists messages (
+		id integer not null primary key,
+		url text not null,
+		author text not null,
+		title text not null,
+		dt_created text not null,
+		summary text
+	);
+	create unique index if not exists url_index on messages(url);
+	create table if not exists responses (
+		threads_id integer,
+		messages_id integer,
+		dt_created text not null,
+		foreign key(threads_id) references threads(id),
+		foreign key(messages_id) references messages(id)
+	);
+	create table if not exists originations (
+		messages_id integer,
+		threads_id integer,
+		foreign key(messages_id) references messages(id),
+		foreign key(threads_id) references threads(id)
+	);
+	`)},
+	{2, "create the known_hosts and known_host_changes tables", migration_statements(`
+	create table if not exists known_hosts (
+		hostname text not null primary key,
+		fingerprint text not null,
+		not_after text not null,
+		dt_created text not null,
+		dt_updated text not null
+	);
+	create table if not exists known_host_changes (
+		id integer not null primary key,
+		hostname text not null,
+		fingerprint text not null,
+		not_after text not null,
+		dt_created text not null
+	);
+	`)},
+	{3, "create the submissions table", migration_statements(`
+	create table if not exists submissions (
+		id integer not null primary key,
+		kind text not null,
+		url text not null,
+		threads_id integer not null default 0,
+		status text not null,
+		attempts integer not null default 0,
+		last_error text not null default '',
+		result_threads_id integer not null default 0,
+		dt_next_attempt text not null,
+		dt_created text not null,
+		dt_updated text not null
+	);
+	create index if not exists submissions_status_index on submissions(status, dt_next_attempt);
+	`)},
+	{4, "create the message_checks table", migration_statements(`
+	create table if not exists message_checks (
+		messages_id integer not null primary key,
+		dt_checked text not null default '',
+		outcome text not null default '',
+		detail text not null default '',
+		dt_next_check text not null
+	);
+	create index if not exists message_checks_next_index on message_checks(dt_next_check);
+	`)},
+	{5, "add message_checks.failures", migration_add_column("message_checks", "failures", "integer not null default 0")},
+	{6, "add message_checks.dt_unreachable", migration_add_column("message_checks", "dt_unreachable", "text not null default ''")},
+	{7, "create the snapshots and message_revisions tables", migration_statements(`
+	create table if not exists snapshots (
+		messages_id integer not null primary key,
+		body text not null,
+		content_hash text not null,
+		media_type text not null,
+		dt_fetched text not null
+	);
+	create table if not exists message_revisions (
+		id integer not null primary key,
+		messages_id integer not null,
+		author text not null,
+		title text not null,
+		summary text,
+		content_hash text not null,
+		body text not null,
+		dt_created text not null
+	);
+	create index if not exists message_revisions_messages_index on message_revisions(messages_id);
+	`)},
+	{8, "create the submission_threads table", migration_statements(`
+	create table if not exists submission_threads (
+		submissions_id integer not null,
+		threads_id integer not null,
+		primary key(submissions_id, threads_id)
+	);
+	`)},
+	{9, "create the thread_policies table", migration_statements(`
+	create table if not exists thread_policies (
+		threads_id integer not null primary key,
+		require_backlinks integer not null default 0
+	);
+	`)},
+	{10, "add responses.parent_message_id", migration_add_column("responses", "parent_message_id", "integer not null default 0")},
+	// SQLite cannot add a foreign key or a constraint to a table, so each table that
+	// refers to a message or a thread is copied into a new table that declares them.
+	// Rows that refer to a message or thread that no longer exists are not copied, and
+	// nor are repeated responses and originations. The search index's triggers are
+	// dropped first, as SQLite cannot rename tables while the triggers refer to an FTS5
+	// table that this build cannot load; db_create_search_index puts them back.
+	// Thread IDs now autoincrement, so that the ID of a thread removed by the integrity
+	// check is never given to another thread.
+	{11, "add cascading foreign keys, keep thread IDs from being reused, and allow each message to respond to a thread only once", migration_statements(drop_search_triggers + `
+	create table threads_new (
+		id integer not null primary key autoincrement,
+		author text not null,
+		title text not null,
+		dt_created text not null,
+		dt_updated text not null
+	);
+	insert into threads_new(id, author, title, dt_created, dt_updated)
+		select id, author, title, dt_created, dt_updated from threads;
+	drop table threads;
+	alter table threads_new rename to threads;
+
+	create table responses_new (
+		threads_id integer not null references threads(id) on delete cascade,
+		messages_id integer not null references messages(id) on delete cascade,
+		dt_created text not null,
+		parent_message_id integer not null default 0,
+		unique(threads_id, messages_id)
+	);
+	insert into responses_new(threads_id, messages_id, dt_created, parent_message_id)
+		select threads_id, messages_id, dt_created, parent_message_id from responses
+		where rowid in (select min(rowid) from responses group by threads_id, messages_id)
+		and threads_id in (select id from threads) and messages_id in (select id from messages);
+	drop table responses;
+	alter table responses_new rename to responses;
+	create index responses_messages_index on responses(messages_id);
+
+	create table originations_new (
+		messages_id integer not null unique references messages(id) on delete cascade,
+		threads_id integer not null unique references threads(id) on delete cascade
+	);
+	insert into originations_new(messages_id, threads_id)
+		select messages_id, threads_id from originations
+		where rowid in (select min(rowid) from originations group by threads_id)
+		and rowid in (select min(rowid) from originations group by messages_id)
+		and threads_id in (select id from threads) and messages_id in (select id from messages);
+	drop table originations;
+	alter table originations_new rename to originations;
+
+	create table message_checks_new (
+		messages_id integer not null primary key references messages(id) on delete cascade,
+		dt_checked text not null default '',
+		outcome text not null default '',
+		detail text not null default '',
+		dt_next_check text not null,
+		failures integer not null default 0,
+		dt_unreachable text not null default ''
+	);
+	insert into message_checks_new(messages_id, dt_checked, outcome, detail, dt_next_check, failures, dt_unreachable)
+		select messages_id, dt_checked, outcome, detail, dt_next_check, failures, dt_unreachable from message_checks
+		where messages_id in (select id from messages);
+	drop table message_checks;
+	alter table message_checks_new rename to message_checks;
+	create index message_checks_next_index on message_checks(dt_next_check);
+
+	create table snapshots_new (
+		messages_id integer not null primary key references messages(id) on delete cascade,
+		body text not null,
+		content_hash text not null,
+		media_type text not null,
+		dt_fetched text not null
+	);
+	insert into snapshots_new(messages_id, body, content_hash, media_type, dt_fetched)
+		select messages_id, body, content_hash, media_type, dt_fetched from snapshots
+		where messages_id in (select id from messages);
+	drop table snapshots;
+	alter table snapshots_new rename to snapshots;
+
+	create table message_revisions_new (
+		id integer not null primary key,
+		messages_id integer not null references messages(id) on delete cascade,
+		author text not null,
+		title text not null,
+		summary text,
+		content_hash text not null,
+		body text not null,
+		dt_created text not null
+	);
+	insert into message_revisions_new(id, messages_id, author, title, summary, content_hash, body, dt_created)
+		select id, messages_id, author, title, summary, content_hash, body, dt_created from message_revisions
+		where messages_id in (select id from messages);
+	drop table message_revisions;
+	alter table message_revisions_new rename to message_revisions;
+	create index message_revisions_messages_index on message_revisions(messages_id);
+
+	create table submission_threads_new (
+		submissions_id integer not null references submissions(id) on delete cascade,
+		threads_id integer not null references threads(id) on delete cascade,
+		primary key(submissions_id, threads_id)
+	);
+	insert into submission_threads_new(submissions_id, threads_id)
+		select submissions_id, threads_id from submission_threads
+		where submissions_id in (select id from submissions) and threads_id in (select id from threads);
+	drop table submission_threads;
+	alter table submission_threads_new rename to submission_threads;
+
+	create table thread_policies_new (
+		threads_id integer not null primary key references threads(id) on delete cascade,
+		require_backlinks integer not null default 0
+	);
+	insert into thread_policies_new(threads_id, require_backlinks)
+		select threads_id, require_backlinks from thread_policies
+		where threads_id in (select id from threads);
+	drop table thread_policies;
+	alter table thread_policies_new rename to thread_policies;
+	`)},
+	{12, "create the message_hashes table", migration_statements(`
+	create table if not exists message_hashes (
+		messages_id integer not null primary key references messages(id) on delete cascade,
+		content_hash text not null
+	);
+	insert or ignore into message_hashes(messages_id, content_hash)
+		select messages_id, content_hash from snapshots;
+	`)},
+}
+
+func latest_schema_version() int {
+	return db_migrations[len(db_migrations)-1].version
+}
+
+// Returns the version of the database's schema, which is 0 if no migrations have been
+// recorded.
+func db_schema_version(db *sql.DB) (int, error) {
+
+	var count int
+	err := db.QueryRow("select count(*) from sqlite_master where type = 'table' and name = 'schema_version'").Scan(&count)
+	if err != nil || count == 0 {
+		return 0, err
+	}
+
+	var version int
+	err = db.QueryRow("select coalesce(max(version), 0) from schema_version").Scan(&version)
+
+	return version, err
+}
+
+// Returns the migrations that have not been applied to the database, or an error if
+// the database is newer than this build of gemthread.
+func db_pending_migrations(db *sql.DB) ([]db_migration, error) {
+
+	version, err := db_schema_version(db)
+	if err != nil {
+		return nil, err
+	}
+
+	if version > latest_schema_version() {
+		return nil, errors.New(fmt.Sprintf("the database's schema is version %d, but this build of gemthread only knows versions up to %d; upgrade gemthread before using this database", version, latest_schema_version()))
+	}
+
+	var pending []db_migration
+	for _, m := range db_migrations {
+		if m.version > version {
+			pending = append(pending, m)
+		}
+	}
+
+	return pending, nil
+}
+
+// Applies the migrations that the database at database_path has not had, and returns
+// them.
+func db_migrate(database_path string) ([]db_migration, error) {
+
+	// Each migration takes the write lock as its transaction begins, so that when
+	// several processes open the database at once, only one of them applies it.
+	// Foreign keys are left off, as SQLite asks while tables are being rebuilt; the
+	// integrity check finds anything that a migration leaves dangling.
+	db, err := sql.Open("sqlite3", database_path+"?_busy_timeout=10000&_txlock=immediate")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	pending, err := db_pending_migrations(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []db_migration
+
+	for _, m := range pending {
+
+		is_applied, err := db_apply_migration(db, m)
+		if err != nil {
+			return applied, errors.New(fmt.Sprintf("unable to apply database migration %d (%s): %s", m.version, m.description, err.Error()))
+		}
+		if is_applied {
+			applied = append(applied, m)
+		}
+	}
+
+	return applied, nil
+}
+
+// Applies a migration and records it, unless another process already has.
+func db_apply_migration(db *sql.DB, m db_migration) (bool, error) {
+
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("create table if not exists schema_version (version integer not null primary key, description text not null, dt_applied text not null)")
+	if err != nil {
+		return false, err
+	}
+
+	var version int
+	err = tx.QueryRow("select coalesce(max(version), 0) from schema_version").Scan(&version)
+	if err != nil {
+		return false, err
+	}
+	if version >= m.version {
+		return false, nil
+	}
+
+	err = m.apply(tx)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = tx.Exec("insert into schema_version(version, description, dt_applied) values(?, ?, ?)", m.version, m.description, now_timestamp())
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// Applies the pending migrations to the database at database_path and says which
+// were applied or, if dry_run is set, only says which would be.
+func print_migrations(database_path string, dry_run bool) error {
+
+	if dry_run {
+		// A database that does not exist yet would be created with every migration
+		if _, err := os.Stat(database_path); errors.Is(err, os.ErrNotExist) {
+			fmt.Println("The database does not exist yet.")
+			for _, m := range db_migrations {
+				fmt.Printf("Would apply migration %d: %s\n", m.version, m.description)
+			}
+			return nil
+		}
+
+		db, err := sql.Open("sqlite3", "file:"+database_path+"?_busy_timeout=10000&mode=ro")
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		version, err := db_schema_version(db)
+		if err != nil {
+			return err
+		}
+
+		pending, err := db_pending_migrations(db)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("The database's schema is version %d.\n", version)
+		if len(pending) == 0 {
+			fmt.Println("No migrations need to be applied.")
+		}
+		for _, m := range pending {
+			fmt.Printf("Would apply migration %d: %s\n", m.version, m.description)
+		}
+		return print_dangling_rows(db)
+	}
+
+	applied, err := db_migrate(database_path)
+	for _, m := range applied {
+		fmt.Printf("Applied migration %d: %s\n", m.version, m.description)
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(applied) == 0 {
+		fmt.Println("No migrations needed to be applied.")
+	}
+	fmt.Printf("The database's schema is version %d.\n", latest_schema_version())
+
+	return nil
+}
+
+// Logs the migrations applied when the database was opened.
+func log_migrations(applied []db_migration) {
+	for _, m := range applied {
+		fmt.Printf("Applied database migration %d: %s\n", m.version, m.description)
+	}
+}
@@ -73,29 +73,117 @@ func scan_line_type(line string) line_type {
 	return line_text
 }
 
-// Parses post to determine author, title, summary, and whether it is prohibited to add the post
-// Returns the parsed message values, whether or not it is OKAY to use the post, and the error, if any
-func parse_post(rawurl string, post_text string) (GemThreadMessage, bool, error) {
+var prohibit_rx = regexp.MustCompile(`(?i)^gemthread[-_\.:]prohibit`)
+var require_backlinks_rx = regexp.MustCompile(`(?i)^gemthread[-_\.:]requirebacklinks`)
+var author_rx = regexp.MustCompile(`(?i)^gemthread[-_\.:]author:[\s]*([\S]+.+)`)
+var title_rx = regexp.MustCompile(`(?i)^gemthread[-_\.:]title:[\s]*([\S]+.+)`)
+var summary_rx = regexp.MustCompile(`(?i)^gemthread[-_\.:]summary:[\s]*([\S]+.+)`)
+var reply_to_rx = regexp.MustCompile(`(?i)^gemthread[-_\.:]replyto:[\s]*([\S]+.+)`)
 
-	prohibit_rx := regexp.MustCompile(`(?i)^gemthread[-_\.:]prohibit`)
-	author_rx := regexp.MustCompile(`(?i)^gemthread[-_\.:]author:[\s]*([\S]+.+)`)
-	title_rx := regexp.MustCompile(`(?i)^gemthread[-_\.:]title:[\s]*([\S]+.+)`)
-	summary_rx := regexp.MustCompile(`(?i)^gemthread[-_\.:]summary:[\s]*([\S]+.+)`)
+type field_result int
+
+const (
+	field_none field_result = iota
+	field_set
+	field_prohibit
+)
+
+// Checks a line for a GemThread field and, if it holds one, applies it to msg.
+// GemThread fields are honored in every supported media type.
+func scan_gemthread_field(line string, msg *GemThreadMessage) field_result {
+
+	prohibit_matches := prohibit_rx.FindStringSubmatch(line)
+	if len(prohibit_matches) > 0 {
+		return field_prohibit
+	}
+
+	if require_backlinks_rx.MatchString(line) {
+		msg.require_backlinks = true
+		return field_set
+	}
+
+	author_matches := author_rx.FindStringSubmatch(line)
+	if len(author_matches) > 0 {
+		author := strings.TrimSpace(author_matches[1])
+		if len(author) > 0 {
+			msg.author = author
+		}
+		return field_set
+	}
+
+	summary_matches := summary_rx.FindStringSubmatch(line)
+	if len(summary_matches) > 0 {
+		summary := strings.TrimSpace(summary_matches[1])
+		if len(summary) > 0 {
+			msg.summary = summary
+		}
+		return field_set
+	}
+
+	reply_to_matches := reply_to_rx.FindStringSubmatch(line)
+	if len(reply_to_matches) > 0 {
+		reply_to := strings.TrimSpace(reply_to_matches[1])
+		if len(reply_to) > 0 {
+			msg.reply_to = reply_to
+		}
+		return field_set
+	}
+
+	title_matches := title_rx.FindStringSubmatch(line)
+	if len(title_matches) > 0 {
+		title := strings.TrimSpace(title_matches[1])
+		if len(title) > 0 {
+			msg.title = title
+		}
+		return field_set
+	}
+
+	return field_none
+}
+
+// Creates the message for a page, with the author taken from the URL.
+func new_parsed_message(rawurl string) (GemThreadMessage, error) {
 
 	var msg GemThreadMessage
 
 	u, err := url.Parse(rawurl)
 	if err != nil {
-		return msg, false, err
+		return msg, err
 	}
 
-	is_allowed := true
 	msg.url = rawurl
 	msg.author = scan_user(rawurl)
 	if len(msg.author) == 0 {
 		msg.author = u.Hostname()
 	}
 
+	return msg, nil
+}
+
+// Parses a fetched page with the extractor for its media type.
+// Returns the parsed message values, whether or not it is OKAY to use the page, and the error, if any
+func parse_page(page fetched_page) (GemThreadMessage, bool, error) {
+	switch page.media_type {
+	case "text/plain":
+		return parse_plain_text(page.url, page.body)
+	case "text/markdown", "text/x-markdown":
+		return parse_markdown(page.url, page.body)
+	default:
+		return parse_post(page.url, page.body)
+	}
+}
+
+// Parses post to determine author, title, summary, and whether it is prohibited to add the post
+// Returns the parsed message values, whether or not it is OKAY to use the post, and the error, if any
+func parse_post(rawurl string, post_text string) (GemThreadMessage, bool, error) {
+
+	msg, err := new_parsed_message(rawurl)
+	if err != nil {
+		return msg, false, err
+	}
+
+	is_allowed := true
+
 	lines := strings.Split(post_text, "\n")
 
 	in_pre_block := false
@@ -116,39 +204,10 @@ func parse_post(rawurl string, post_text string) (GemThreadMessage, bool, error)
 
 		if lt == line_text {
 
-			prohibit_matches := prohibit_rx.FindStringSubmatch(line)
-			if len(prohibit_matches) > 0 {
-				is_allowed = false
-				msg.author = ""
-				msg.summary = ""
-				msg.title = ""
-				return msg, is_allowed, nil
-			}
-
-			author_matches := author_rx.FindStringSubmatch(line)
-			if len(author_matches) > 0 {
-				author := strings.TrimSpace(author_matches[1])
-				if len(author) > 0 {
-					msg.author = author
-				}
-				continue
-			}
-
-			summary_matches := summary_rx.FindStringSubmatch(line)
-			if len(summary_matches) > 0 {
-				summary := strings.TrimSpace(summary_matches[1])
-				if len(summary) > 0 {
-					msg.summary = summary
-				}
-				continue
-			}
-
-			title_matches := title_rx.FindStringSubmatch(line)
-			if len(title_matches) > 0 {
-				title := strings.TrimSpace(title_matches[1])
-				if len(title) > 0 {
-					msg.title = title
-				}
+			switch scan_gemthread_field(line, &msg) {
+			case field_prohibit:
+				return prohibited_message(msg), false, nil
+			case field_set:
 				continue
 			}
 
@@ -179,3 +238,189 @@ func parse_post(rawurl string, post_text string) (GemThreadMessage, bool, error)
 
 	return msg, is_allowed, nil
 }
+
+func prohibited_message(msg GemThreadMessage) GemThreadMessage {
+	msg.author = ""
+	msg.summary = ""
+	msg.title = ""
+	return msg
+}
+
+// Parses a text/plain page. Plain text has no headings, so the first non-blank line
+// is the title and the next one is the summary.
+func parse_plain_text(rawurl string, post_text string) (GemThreadMessage, bool, error) {
+
+	msg, err := new_parsed_message(rawurl)
+	if err != nil {
+		return msg, false, err
+	}
+
+	var title, summary string
+
+	for _, line := range strings.Split(post_text, "\n") {
+
+		line = strings.TrimRight(line, "\r")
+
+		switch scan_gemthread_field(line, &msg) {
+		case field_prohibit:
+			return prohibited_message(msg), false, nil
+		case field_set:
+			continue
+		}
+
+		line = strings.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		if len(title) == 0 {
+			title = line
+		} else if len(summary) == 0 {
+			summary = line
+		}
+	}
+
+	if len(msg.title) == 0 {
+		msg.title = title
+	}
+	if len(msg.summary) == 0 {
+		msg.summary = summary
+	}
+	if len(msg.title) == 0 {
+		msg.title = "Untitled"
+	}
+
+	return msg, true, nil
+}
+
+var markdown_atx_heading_rx = regexp.MustCompile(`^[ ]{0,3}(#{1,6})(?:[ \t]+(.*?))?(?:[ \t]+#+)?[ \t]*$`)
+var markdown_setext_underline_rx = regexp.MustCompile(`^[ ]{0,3}(=+|-+)[ \t]*$`)
+var markdown_fence_rx = regexp.MustCompile("^[ ]{0,3}(```|~~~)")
+var markdown_block_rx = regexp.MustCompile(`^[ ]{0,3}([-*+][ \t]|[0-9]+[.)][ \t]|>|\[[^\]]+\]:|<|\|)`)
+
+// Parses a text/markdown page. The first heading (ATX or setext) is the title and the
+// first line of the first paragraph is the summary.
+func parse_markdown(rawurl string, post_text string) (GemThreadMessage, bool, error) {
+
+	msg, err := new_parsed_message(rawurl)
+	if err != nil {
+		return msg, false, err
+	}
+
+	lines := strings.Split(post_text, "\n")
+	for i := range lines {
+		lines[i] = strings.TrimRight(lines[i], "\r")
+	}
+
+	var title, summary string
+	in_fence := false
+
+	for i, line := range lines {
+
+		if markdown_fence_rx.MatchString(line) {
+			in_fence = !in_fence
+			continue
+		}
+
+		if in_fence {
+			continue
+		}
+
+		switch scan_gemthread_field(line, &msg) {
+		case field_prohibit:
+			return prohibited_message(msg), false, nil
+		case field_set:
+			continue
+		}
+
+		if len(strings.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		if m := markdown_atx_heading_rx.FindStringSubmatch(line); m != nil {
+			if len(title) == 0 {
+				title = strings.TrimSpace(m[2])
+			}
+			continue
+		}
+
+		if markdown_setext_underline_rx.MatchString(line) {
+			continue
+		}
+
+		if i+1 < len(lines) && markdown_setext_underline_rx.MatchString(lines[i+1]) && !markdown_block_rx.MatchString(line) {
+			if len(title) == 0 {
+				title = strings.TrimSpace(line)
+			}
+			continue
+		}
+
+		if markdown_block_rx.MatchString(line) || strings.HasPrefix(line, "    ") || strings.HasPrefix(line, "\t") {
+			continue
+		}
+
+		if len(summary) == 0 {
+			summary = strings.TrimSpace(line)
+		}
+	}
+
+	if len(msg.title) == 0 {
+		msg.title = title
+	}
+	if len(msg.summary) == 0 {
+		msg.summary = summary
+	}
+	if len(msg.title) == 0 {
+		msg.title = "Untitled"
+	}
+
+	return msg, true, nil
+}
+
+// Returns the targets of a gemtext page's link lines, resolved against the page's URL.
+// Links inside preformatted text are not links, and pages of other media types have
+// none.
+func page_links(page fetched_page) []string {
+
+	var links []string
+
+	if page.media_type != "text/gemini" {
+		return links
+	}
+
+	base, err := url.Parse(page.url)
+	if err != nil {
+		return links
+	}
+
+	in_pre_block := false
+
+	for _, line := range strings.Split(page.body, "\n") {
+
+		lt := scan_line_type(line)
+
+		if lt == line_pre {
+			in_pre_block = !in_pre_block
+			continue
+		}
+
+		if in_pre_block || lt != line_link {
+			continue
+		}
+
+		fields := strings.Fields(line[len("=>"):])
+		if len(fields) == 0 {
+			continue
+		}
+
+		link, err := base.Parse(fields[0])
+		if err != nil {
+			continue
+		}
+		link.Fragment = ""
+
+		links = append(links, link.String())
+	}
+
+	return links
+}
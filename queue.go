@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"git.sr.ht/~adnano/go-gemini"
+)
+
+// New threads and responses are not fetched while the submitter waits. Each
+// submission is recorded in the submissions table and the submitter is sent to a page
+// that shows its status, while a pool of workers fetches the submitted pages. A fetch
+// that fails is retried with exponential backoff until the queue's max_attempts is
+// reached, and the submission is then marked as failed with the last error.
+
+type GemThreadSubmission struct {
+	id                int64
+	kind              submission_kind
+	url               string
+	threads_id        int64
+	status            string
+	attempts          int
+	last_error        string
+	result_threads_id int64
+	dt_next_attempt   string
+	dt_created        string
+	dt_updated        string
+	// For responses submitted to /respond: the threads that the response was added
+	// to or, while its status is submission_choose, the threads to choose from
+	threads []GemThreadThread
+}
+
+func (sub GemThreadSubmission) String() string {
+
+	rstr := fmt.Sprintf("# Submission %d\r\n", sub.id)
+	switch sub.kind {
+	case submission_response:
+		rstr += fmt.Sprintf("A response to thread %d, submitted %s\r\n", sub.threads_id, sub.dt_created)
+	case submission_auto_response:
+		rstr += fmt.Sprintf("A response to the threads that it links to, submitted %s\r\n", sub.dt_created)
+	default:
+		rstr += fmt.Sprintf("A new thread, submitted %s\r\n", sub.dt_created)
+	}
+	rstr += "=> " + sub.url + "\r\n"
+
+	switch sub.status {
+	case submission_done:
+		rstr += "Status: added to these threads:\r\n"
+		for _, thr := range sub.threads {
+			rstr += fmt.Sprintf("=> %s/threads/%d %s — %s\r\n", server_url(), thr.id, thr.author, thr.title)
+		}
+	case submission_choose:
+		rstr += "Status: the page links to messages that are in more than one thread. Choose the thread that it responds to:\r\n"
+		for _, thr := range sub.threads {
+			rstr += fmt.Sprintf("=> %s/threads/%d/respond?%s %s — %s\r\n", server_url(), thr.id, url.QueryEscape(sub.url), thr.author, thr.title)
+		}
+	case submission_failed:
+		if sub.attempts == 1 {
+			rstr += "Status: failed\r\n"
+		} else {
+			rstr += fmt.Sprintf("Status: failed after %d attempts\r\n", sub.attempts)
+		}
+	case submission_running:
+		rstr += "Status: fetching the page now\r\n"
+	default:
+		if sub.attempts == 0 {
+			rstr += "Status: waiting to be fetched\r\n"
+		} else {
+			rstr += fmt.Sprintf("Status: %d of %d attempts made; next attempt at %s\r\n", sub.attempts, config().Queue.MaxAttempts, sub.dt_next_attempt)
+		}
+	}
+
+	if len(sub.last_error) > 0 {
+		rstr += "Last error: " + sub.last_error + "\r\n"
+	}
+
+	if sub.status == submission_pending || sub.status == submission_running {
+		rstr += fmt.Sprintf("=> %s/submissions/%d Check again\r\n", server_url(), sub.id)
+	}
+	if sub.kind == submission_response {
+		rstr += fmt.Sprintf("=> %s/threads/%d Return to the thread\r\n", server_url(), sub.threads_id)
+	}
+	rstr += fmt.Sprintf("=> %s/threads/ See all threads\r\n", server_url())
+
+	return rstr
+}
+
+const (
+	submission_pending = "pending"
+	submission_running = "running"
+	submission_done    = "done"
+	submission_failed  = "failed"
+	// The submitter must choose which thread a response belongs to
+	submission_choose = "choose"
+)
+
+// How often idle workers look for submissions whose next attempt has come due
+const submission_poll_interval = 5 * time.Second
+
+// A submission still marked as running after this long was abandoned by a process
+// that exited while fetching it.
+const stale_submission_age = time.Hour
+
+// A rejected_error is a reason for refusing a submission that will not change if the
+// page is fetched again.
+type rejected_error struct {
+	message string
+}
+
+func (e rejected_error) Error() string {
+	return e.message
+}
+
+// Reports whether err is a reply from the remote server, other than a temporary
+// failure, that it will most likely give again if the page is fetched again.
+func is_permanent_fetch_error(err error) bool {
+	var fetch_err fetch_error
+	return errors.As(err, &fetch_err) && fetch_err.status != 0 && fetch_err.status.Class() != gemini.StatusTemporaryFailure
+}
+
+var _submission_wake = make(chan struct{}, 1)
+
+// Tells an idle worker that a submission is waiting.
+func wake_submission_workers() {
+	select {
+	case _submission_wake <- struct{}{}:
+	default:
+	}
+}
+
+// Queues a submission and returns its ID.
+func queue_submission(db *sql.DB, kind submission_kind, tgt_url string, thread_id int64) (int64, error) {
+
+	sub_id, err := db_insert_submission(db, kind, tgt_url, thread_id)
+	if err != nil {
+		return -1, err
+	}
+
+	wake_submission_workers()
+
+	return sub_id, nil
+}
+
+// The delay before the next attempt at a submission that has failed attempts times,
+// which doubles with each failure.
+func submission_retry_delay(attempts int) time.Duration {
+
+	delay := config().Queue.RetryDelay.Duration
+	max_delay := config().Queue.MaxRetryDelay.Duration
+
+	for i := 1; i < attempts && delay < max_delay; i++ {
+		delay *= 2
+	}
+
+	if delay > max_delay {
+		delay = max_delay
+	}
+
+	return delay
+}
+
+// Fetches the submitted page and adds it to the database, returning the IDs of the
+// threads that it was added to.
+func process_submission(ctx context.Context, db *sql.DB, sub GemThreadSubmission) ([]int64, error) {
+
+	page, err := retrieve(ctx, db, sub.url, true)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, is_allowed, err := parse_page(page)
+	if err != nil {
+		return nil, rejected_error{"unable to parse " + sub.url + " contents: " + err.Error()}
+	}
+
+	if !is_allowed {
+		return nil, rejected_error{"PROHIBITED: the requested page contains \"GemThread.Prohibit\""}
+	}
+
+	thr_ids := []int64{sub.threads_id}
+
+	switch sub.kind {
+	case submission_response:
+		links := page_links(page)
+		err = check_backlink(db, sub.threads_id, page.media_type, links)
+		if err != nil {
+			return nil, err
+		}
+		parent_id, err := find_reply_parent(db, sub.threads_id, msg, links)
+		if err != nil {
+			return nil, errors.New("unable to find the response that the page replies to: " + err.Error())
+		}
+		_, err = db_insert_response_message(db, sub.threads_id, msg, parent_id)
+		if err != nil {
+			return nil, errors.New("unable to insert message: " + err.Error())
+		}
+	case submission_auto_response:
+		thr_ids, err = add_linked_response(db, msg, page_links(page))
+		if err != nil {
+			return nil, err
+		}
+	default:
+		thr_id, err := db_create_new_thread(db, msg)
+		if err != nil && thr_id < 0 {
+			return nil, err
+		}
+		// Otherwise, this is a pre-existing thread, and we simply continue.
+		thr_ids = []int64{thr_id}
+	}
+
+	saved_msg, err := db_find_existing_message_by_url(db, msg.url)
+	if err != nil {
+		return nil, errors.New("unable to find message: " + err.Error())
+	}
+
+	saved_msg.require_backlinks = msg.require_backlinks
+	err = save_thread_policy(db, saved_msg)
+	if err != nil {
+		return nil, errors.New("unable to save thread policy: " + err.Error())
+	}
+
+	err = save_page_hash(db, saved_msg.id, page)
+	if err != nil {
+		return nil, errors.New("unable to save page hash: " + err.Error())
+	}
+
+	err = save_snapshot(db, saved_msg.id, page)
+	if err != nil {
+		fmt.Printf("Unable to save snapshot of %s: %s\n", msg.url, err.Error())
+	}
+
+	return thr_ids, nil
+}
+
+// Makes an attempt at a claimed submission and records the outcome.
+func run_submission(ctx context.Context, db *sql.DB, sub GemThreadSubmission) {
+
+	thr_ids, err := process_submission(ctx, db, sub)
+
+	var slow_down_err slow_down_error
+	var rejected_err rejected_error
+	var robots_err robots_error
+	var ambiguous_err ambiguous_response_error
+
+	switch {
+	case err == nil:
+		sub.status = submission_done
+		sub.result_threads_id = thr_ids[0]
+		sub.last_error = ""
+		if sub.kind == submission_auto_response {
+			err = db_save_submission_threads(db, sub.id, thr_ids)
+			if err != nil {
+				fmt.Printf("Unable to record the threads of submission %d: %s\n", sub.id, err.Error())
+			}
+		}
+
+	case errors.As(err, &ambiguous_err):
+		sub.status = submission_choose
+		sub.last_error = ""
+		err = db_save_submission_threads(db, sub.id, ambiguous_err.candidates)
+		if err != nil {
+			sub.status = submission_failed
+			sub.last_error = "unable to record the threads to choose from: " + err.Error()
+		}
+
+	case ctx.Err() != nil:
+		// The server is shutting down; this attempt does not count.
+		sub.status = submission_pending
+		sub.attempts--
+
+	case errors.As(err, &slow_down_err):
+		// The capsule has been fetched from too often; this attempt does not count.
+		sub.status = submission_pending
+		sub.attempts--
+		sub.dt_next_attempt = format_timestamp(time.Now().Add(slow_down_err.wait))
+
+	case errors.As(err, &rejected_err), errors.As(err, &robots_err), is_permanent_fetch_error(err), sub.attempts >= config().Queue.MaxAttempts:
+		sub.status = submission_failed
+		sub.last_error = submission_error_message(sub.url, err)
+
+	default:
+		sub.status = submission_pending
+		sub.last_error = submission_error_message(sub.url, err)
+		sub.dt_next_attempt = format_timestamp(time.Now().Add(submission_retry_delay(sub.attempts)))
+	}
+
+	err = db_update_submission(db, sub)
+	if err != nil {
+		fmt.Printf("Unable to record the outcome of submission %d: %s\n", sub.id, err.Error())
+	}
+}
+
+// Claims and runs submissions until none are due or shutdown is closed.
+func run_due_submissions(ctx context.Context, db *sql.DB, shutdown <-chan struct{}) {
+	for {
+		select {
+		case <-shutdown:
+			return
+		default:
+		}
+
+		sub, err := db_claim_submission(db)
+		if err != nil {
+			fmt.Printf("Unable to claim a submission: %s\n", err.Error())
+			return
+		}
+		if sub.id == 0 {
+			return
+		}
+
+		run_submission(ctx, db, sub)
+	}
+}
+
+func run_submission_worker(ctx context.Context, db *sql.DB, shutdown <-chan struct{}) {
+	for {
+		run_due_submissions(ctx, db, shutdown)
+
+		select {
+		case <-shutdown:
+			return
+		case <-_submission_wake:
+		case <-time.After(submission_poll_interval):
+		}
+	}
+}
+
+// Starts the queue's workers. Each worker is added to wg, and returns once shutdown
+// is closed and it has finished the submission it is working on. Cancelling ctx
+// abandons those submissions, which are then retried when the server next starts.
+func start_submission_workers(ctx context.Context, db *sql.DB, shutdown <-chan struct{}, wg *sync.WaitGroup) {
+
+	err := db_requeue_running_submissions(db, time.Now())
+	if err != nil {
+		fmt.Printf("Unable to requeue interrupted submissions: %s\n", err.Error())
+	}
+
+	for i := 0; i < config().Queue.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			run_submission_worker(ctx, db, shutdown)
+		}()
+	}
+}
+
+// Runs the submissions that are due without starting any workers, for CGI mode, where
+// each process handles a single request.
+func run_submissions_once(ctx context.Context, db *sql.DB) {
+
+	err := db_requeue_running_submissions(db, time.Now().Add(-stale_submission_age))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to requeue abandoned submissions: %s\n", err.Error())
+	}
+
+	run_due_submissions(ctx, db, nil)
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"git.sr.ht/~adnano/go-gemini"
+)
+
+// Every message is fetched again periodically, so that edits to a page, and
+// "GemThread.Prohibit" lines added to it, are picked up without its author having to
+// visit the update URL. Each message is checked about once per refresh interval, give
+// or take the refresh jitter, so that checks are spread out over time rather than all
+// happening at once. When and with what outcome each message was last checked is
+// recorded in the message_checks table.
+//
+// A message whose page is gone (52 GONE) is removed, as if it had been prohibited. A
+// message whose page is not found (51 NOT FOUND), or whose server cannot be reached,
+// on unreachable_after checks in a row is marked as unreachable until a later check
+// succeeds.
+
+type GemThreadMessageCheck struct {
+	messages_id   int64
+	dt_checked    string
+	outcome       string
+	detail        string
+	dt_next_check string
+	// Checks in a row that found the message unreachable
+	failures       int
+	dt_unreachable string
+}
+
+// Outcomes of a check
+const (
+	check_unchanged = "unchanged"
+	check_updated   = "updated"
+	check_removed   = "removed"
+	check_gone      = "gone"
+	check_failed    = "failed"
+)
+
+func (check GemThreadMessageCheck) String() string {
+	if len(check.dt_checked) == 0 {
+		return "Not yet checked for changes"
+	}
+	rstr := "Last checked for changes " + check.dt_checked + ": " + check.outcome
+	if len(check.detail) > 0 {
+		rstr += " (" + check.detail + ")"
+	}
+	if len(check.dt_unreachable) > 0 {
+		rstr += "; unreachable since " + check.dt_unreachable
+	}
+	return rstr
+}
+
+// How often the refresher looks for messages that are due to be checked
+const refresh_poll_interval = time.Minute
+
+// The time until a message is next checked: the refresh interval, plus or minus up to
+// the refresh jitter.
+func next_check_delay() time.Duration {
+
+	delay := config().Refresh.Interval.Duration
+
+	if jitter := config().Refresh.Jitter.Duration; jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(2*jitter))) - jitter
+	}
+
+	if delay < refresh_poll_interval {
+		delay = refresh_poll_interval
+	}
+
+	return delay
+}
+
+// Records the outcome of a check of a message. err is the reason that the check
+// failed, if it did.
+func record_message_check(db *sql.DB, saved_msg GemThreadMessage, outcome string, err error) error {
+
+	check, find_err := db_find_message_check(db, saved_msg.id)
+	if find_err != nil {
+		return find_err
+	}
+
+	check.messages_id = saved_msg.id
+	check.dt_checked = now_timestamp()
+	check.outcome = outcome
+	check.detail = ""
+	check.dt_next_check = format_timestamp(time.Now().Add(next_check_delay()))
+
+	if err != nil {
+		check.detail = submission_error_message(saved_msg.url, err)
+	}
+
+	switch {
+	case err == nil:
+		check.failures = 0
+		check.dt_unreachable = ""
+	case is_unreachable_error(err):
+		check.failures++
+		if check.failures >= config().Refresh.UnreachableAfter && len(check.dt_unreachable) == 0 {
+			check.dt_unreachable = check.dt_checked
+		}
+	}
+
+	return db_save_message_check(db, check)
+}
+
+// Records that a message could not be checked, unless the fetch was refused by the
+// rate limits or abandoned, and returns err.
+func record_failed_check(ctx context.Context, db *sql.DB, saved_msg GemThreadMessage, err error) error {
+
+	var slow_down_err slow_down_error
+	if errors.As(err, &slow_down_err) || ctx.Err() != nil {
+		return err
+	}
+
+	record_err := record_message_check(db, saved_msg, check_failed, err)
+	if record_err != nil {
+		fmt.Printf("Unable to record check of message %d: %s\n", saved_msg.id, record_err.Error())
+	}
+
+	return err
+}
+
+// Fetches a message's page again and updates the message to match it, or removes the
+// message if the page now contains "GemThread.Prohibit" or is gone. use_cache is
+// passed to retrieve(); an update that the page's author asked for is never answered
+// from the page cache, so that a change they just made is seen. If the page could not
+// be fetched or parsed, the outcome is check_failed and the error says why; any other
+// error is from the database.
+func refresh_message(ctx context.Context, db *sql.DB, saved_msg GemThreadMessage, use_cache bool) (GemThreadMessage, string, error) {
+
+	result, err := retrieve(ctx, db, saved_msg.url, use_cache)
+
+	var fetch_err fetch_error
+	if errors.As(err, &fetch_err) && fetch_err.status == gemini.StatusGone {
+		_, err = db_delete_message(db, saved_msg)
+		if err != nil {
+			return saved_msg, "", errors.New("unable to delete message: " + err.Error())
+		}
+		return saved_msg, check_gone, nil
+	}
+
+	if err != nil {
+		return saved_msg, check_failed, record_failed_check(ctx, db, saved_msg, err)
+	}
+
+	retrieved_msg, is_allowed, err := parse_page(result)
+	if err != nil {
+		err = rejected_error{"unable to parse " + saved_msg.url + " contents: " + err.Error()}
+		return saved_msg, check_failed, record_failed_check(ctx, db, saved_msg, err)
+	}
+
+	if !is_allowed {
+		_, err = db_delete_message(db, saved_msg)
+		if err != nil {
+			return saved_msg, "", errors.New("unable to delete message: " + err.Error())
+		}
+		return saved_msg, check_removed, nil
+	}
+
+	saved_msg.require_backlinks = retrieved_msg.require_backlinks
+	err = save_thread_policy(db, saved_msg)
+	if err != nil {
+		return saved_msg, "", errors.New("unable to save thread policy: " + err.Error())
+	}
+
+	saved_msg.reply_to = retrieved_msg.reply_to
+	err = update_reply_parents(db, saved_msg, page_links(result))
+	if err != nil {
+		return saved_msg, "", errors.New("unable to update reply tree: " + err.Error())
+	}
+
+	prev_snap, err := db_find_snapshot(db, saved_msg.id)
+	if err != nil {
+		return saved_msg, "", errors.New("unable to find snapshot: " + err.Error())
+	}
+
+	prev_hash, err := db_find_message_hash(db, saved_msg.id)
+	if err != nil {
+		return saved_msg, "", errors.New("unable to find page hash: " + err.Error())
+	}
+
+	outcome := check_unchanged
+
+	metadata_changed := retrieved_msg.author != saved_msg.author || retrieved_msg.title != saved_msg.title || retrieved_msg.summary != saved_msg.summary
+	content_changed := len(prev_hash) > 0 && prev_hash != content_hash(result.body)
+
+	if metadata_changed || content_changed {
+		err = save_message_revision(db, saved_msg, retrieved_msg, prev_hash, prev_snap)
+		if err != nil {
+			return saved_msg, "", errors.New("unable to update message: " + err.Error())
+		}
+		saved_msg.author = retrieved_msg.author
+		saved_msg.title = retrieved_msg.title
+		saved_msg.summary = retrieved_msg.summary
+		outcome = check_updated
+	}
+
+	err = save_page_hash(db, saved_msg.id, result)
+	if err != nil {
+		return saved_msg, "", errors.New("unable to save page hash: " + err.Error())
+	}
+
+	err = save_snapshot(db, saved_msg.id, result)
+	if err != nil {
+		fmt.Printf("Unable to save snapshot of %s: %s\n", saved_msg.url, err.Error())
+	}
+
+	return saved_msg, outcome, record_message_check(db, saved_msg, outcome, nil)
+}
+
+// Schedules the first check of messages that have not been checked before. The checks
+// are spread out over the refresh interval.
+func schedule_new_message_checks(db *sql.DB) error {
+
+	msg_ids, err := db_list_unscheduled_message_ids(db)
+	if err != nil {
+		return err
+	}
+
+	interval := int64(config().Refresh.Interval.Duration)
+
+	for _, msg_id := range msg_ids {
+		err = db_save_message_check(db, GemThreadMessageCheck{
+			messages_id:   msg_id,
+			dt_next_check: format_timestamp(time.Now().Add(time.Duration(rand.Int63n(interval)))),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Checks the messages that are due to be checked, one at a time, until none are due
+// or shutdown is closed.
+func run_due_message_checks(ctx context.Context, db *sql.DB, shutdown <-chan struct{}) {
+	for {
+		select {
+		case <-shutdown:
+			return
+		default:
+		}
+
+		check, err := db_find_next_message_check(db)
+		if err != nil {
+			fmt.Printf("Unable to find the next message to check: %s\n", err.Error())
+			return
+		}
+		if check.messages_id == 0 {
+			return
+		}
+
+		saved_msg, err := db_find_message_by_id(db, check.messages_id)
+		if err == nil && saved_msg.id == 0 {
+			// The message has been deleted
+			err = db_delete_message_check(db, check.messages_id)
+		}
+		if err != nil {
+			fmt.Printf("Unable to check message %d: %s\n", check.messages_id, err.Error())
+			return
+		}
+		if saved_msg.id == 0 {
+			continue
+		}
+
+		// Schedule the next check first, so that the message is not checked again
+		// straight away if this check cannot be recorded.
+		check.dt_next_check = format_timestamp(time.Now().Add(next_check_delay()))
+		err = db_save_message_check(db, check)
+		if err != nil {
+			fmt.Printf("Unable to schedule check of message %d: %s\n", saved_msg.id, err.Error())
+			return
+		}
+
+		_, outcome, err := refresh_message(ctx, db, saved_msg, true)
+
+		var slow_down_err slow_down_error
+		switch {
+		case ctx.Err() != nil:
+			return
+		case errors.As(err, &slow_down_err):
+			check.dt_next_check = format_timestamp(time.Now().Add(slow_down_err.wait))
+			err = db_save_message_check(db, check)
+		case outcome == check_removed:
+			fmt.Printf("Removed message %d (%s) in response to \"GemThread.Prohibit\" line\n", saved_msg.id, saved_msg.url)
+		case outcome == check_gone:
+			fmt.Printf("Removed message %d (%s) because its page is gone\n", saved_msg.id, saved_msg.url)
+		case outcome == check_failed:
+			// Already recorded
+			err = nil
+		}
+		if err != nil {
+			fmt.Printf("Unable to check message %d: %s\n", saved_msg.id, err.Error())
+		}
+	}
+}
+
+func run_refresher(ctx context.Context, db *sql.DB, shutdown <-chan struct{}) {
+	for {
+		if config().Refresh.Enabled {
+			err := schedule_new_message_checks(db)
+			if err != nil {
+				fmt.Printf("Unable to schedule message checks: %s\n", err.Error())
+			}
+			run_due_message_checks(ctx, db, shutdown)
+		}
+
+		select {
+		case <-shutdown:
+			return
+		case <-time.After(refresh_poll_interval):
+		}
+	}
+}
+
+// Starts the refresher, which is added to wg, and returns once shutdown is closed and
+// it has finished the check it is working on.
+func start_refresher(ctx context.Context, db *sql.DB, shutdown <-chan struct{}, wg *sync.WaitGroup) {
+	rand.Seed(time.Now().UnixNano())
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		run_refresher(ctx, db, shutdown)
+	}()
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"database/sql"
+	"net/url"
+)
+
+// A response can reply to another response in its thread rather than to the thread
+// itself. The response it replies to is its parent, recorded in the responses table's
+// parent_message_id column, and the thread page shows the responses as a tree. The
+// parent is the response named by a "GemThread.ReplyTo" line on the page or, if there
+// is none, the first response in the thread that the page links to. A page that
+// links to neither replies to the thread itself.
+
+// Returns the ID of the response in a thread that a link is to, if it is to one, and
+// whether the link is to a message in the thread or to the thread itself.
+func linked_thread_message(db *sql.DB, thr_id int64, link string) (int64, bool, error) {
+
+	if local_link_id(link, "threads") == thr_id {
+		return 0, true, nil
+	}
+
+	msg_id := local_link_id(link, "messages")
+	if msg_id == 0 {
+		msg, err := db_find_existing_message_by_url(db, link)
+		if err != nil || msg.url != link {
+			return 0, false, err
+		}
+		msg_id = msg.id
+	}
+
+	is_response, err := db_is_response_in_thread(db, thr_id, msg_id)
+	if err != nil {
+		return 0, false, err
+	}
+	if is_response {
+		return msg_id, true, nil
+	}
+
+	origin, err := db_find_thread_by_originating_message_id(db, msg_id)
+	if err != nil {
+		return 0, false, err
+	}
+
+	return 0, origin.id == thr_id, nil
+}
+
+// Returns the ID of the response in a thread that msg replies to, or 0 if it replies
+// to the thread itself. links are the links on msg's page.
+func find_reply_parent(db *sql.DB, thr_id int64, msg GemThreadMessage, links []string) (int64, error) {
+
+	if len(msg.reply_to) > 0 {
+		base, err := url.Parse(msg.url)
+		if err != nil {
+			return 0, err
+		}
+		reply_to, err := base.Parse(msg.reply_to)
+		if err == nil {
+			reply_to.Fragment = ""
+			parent_id, in_thread, err := linked_thread_message(db, thr_id, reply_to.String())
+			if err != nil {
+				return 0, err
+			}
+			is_self := parent_id > 0 && parent_id == msg.id
+			if in_thread && !is_self {
+				return parent_id, nil
+			}
+		}
+		// A ReplyTo line that names nothing else in this thread is ignored
+	}
+
+	for _, link := range links {
+
+		if link == msg.url {
+			continue
+		}
+
+		parent_id, _, err := linked_thread_message(db, thr_id, link)
+		if err != nil {
+			return 0, err
+		}
+		if parent_id > 0 && parent_id != msg.id {
+			return parent_id, nil
+		}
+	}
+
+	return 0, nil
+}
+
+// Works out again which response msg replies to in each thread that it responds to,
+// after its page has been fetched again.
+func update_reply_parents(db *sql.DB, msg GemThreadMessage, links []string) error {
+
+	thrs, err := db_find_threads_by_responding_message_id(db, msg.id)
+	if err != nil {
+		return err
+	}
+
+	for _, thr := range thrs {
+
+		parent_id, err := find_reply_parent(db, thr.id, msg, links)
+		if err != nil {
+			return err
+		}
+
+		err = db_update_response_parent(db, thr.id, msg.id, parent_id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Arranges a thread's messages, as returned by db_find_messages_for_thread, into a
+// reply tree, and returns them in the order that they are shown along with the depth
+// of each. parents is the parent of each response that has one. Replies to the same
+// message keep the order that they were given in.
+func reply_tree(msgs []GemThreadMessage, parents map[int64]int64) ([]GemThreadMessage, []int) {
+
+	in_thread := make(map[int64]bool)
+	for _, msg := range msgs {
+		in_thread[msg.id] = true
+	}
+
+	var roots []GemThreadMessage
+	children := make(map[int64][]GemThreadMessage)
+
+	for _, msg := range msgs {
+		parent_id := parents[msg.id]
+		if parent_id != 0 && parent_id != msg.id && in_thread[parent_id] {
+			children[parent_id] = append(children[parent_id], msg)
+		} else {
+			roots = append(roots, msg)
+		}
+	}
+
+	var tree []GemThreadMessage
+	var depths []int
+	visited := make(map[int64]bool)
+
+	var visit func(msg GemThreadMessage, depth int)
+	visit = func(msg GemThreadMessage, depth int) {
+		if visited[msg.id] {
+			return
+		}
+		visited[msg.id] = true
+		tree = append(tree, msg)
+		depths = append(depths, depth)
+		for _, child := range children[msg.id] {
+			visit(child, depth+1)
+		}
+	}
+
+	for _, msg := range roots {
+		visit(msg, 0)
+	}
+
+	// Responses that reply to each other in a loop cannot be reached from the roots
+	for _, msg := range msgs {
+		visit(msg, 0)
+	}
+
+	return tree, depths
+}
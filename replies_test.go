@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReplyTree(t *testing.T) {
+
+	msgs := func(ids ...int64) []GemThreadMessage {
+		var m []GemThreadMessage
+		for _, id := range ids {
+			m = append(m, GemThreadMessage{id: id})
+		}
+		return m
+	}
+
+	tests := []struct {
+		name       string
+		msgs       []GemThreadMessage
+		parents    map[int64]int64
+		want_ids   []int64
+		want_depth []int
+	}{
+		{
+			name:       "no replies",
+			msgs:       msgs(1, 2, 3),
+			parents:    map[int64]int64{},
+			want_ids:   []int64{1, 2, 3},
+			want_depth: []int{0, 0, 0},
+		},
+		{
+			name:       "nested replies follow their parents",
+			msgs:       msgs(1, 2, 3, 4),
+			parents:    map[int64]int64{3: 1, 4: 3},
+			want_ids:   []int64{1, 3, 4, 2},
+			want_depth: []int{0, 1, 2, 0},
+		},
+		{
+			name:       "replies to the same message keep their order",
+			msgs:       msgs(1, 2, 3, 4),
+			parents:    map[int64]int64{2: 1, 3: 1, 4: 1},
+			want_ids:   []int64{1, 2, 3, 4},
+			want_depth: []int{0, 1, 1, 1},
+		},
+		{
+			name:       "a reply to a message before it in the list",
+			msgs:       msgs(3, 2, 1),
+			parents:    map[int64]int64{3: 1},
+			want_ids:   []int64{2, 1, 3},
+			want_depth: []int{0, 0, 1},
+		},
+		{
+			name:       "a parent outside the thread is ignored",
+			msgs:       msgs(1, 2),
+			parents:    map[int64]int64{2: 99},
+			want_ids:   []int64{1, 2},
+			want_depth: []int{0, 0},
+		},
+		{
+			name:       "a reply to itself is ignored",
+			msgs:       msgs(1, 2),
+			parents:    map[int64]int64{2: 2},
+			want_ids:   []int64{1, 2},
+			want_depth: []int{0, 0},
+		},
+		{
+			name:       "replies in a loop are each shown once",
+			msgs:       msgs(1, 2, 3),
+			parents:    map[int64]int64{2: 3, 3: 2},
+			want_ids:   []int64{1, 2, 3},
+			want_depth: []int{0, 0, 1},
+		},
+		{
+			name:       "a reply to a loop is shown under it",
+			msgs:       msgs(1, 2, 3, 4),
+			parents:    map[int64]int64{1: 2, 2: 1, 4: 2},
+			want_ids:   []int64{3, 1, 2, 4},
+			want_depth: []int{0, 0, 1, 2},
+		},
+	}
+
+	for _, test := range tests {
+		tree, depths := reply_tree(test.msgs, test.parents)
+		var ids []int64
+		for _, msg := range tree {
+			ids = append(ids, msg.id)
+		}
+		if !reflect.DeepEqual(ids, test.want_ids) || !reflect.DeepEqual(depths, test.want_depth) {
+			t.Errorf("%s: got %v at depths %v, want %v at depths %v", test.name, ids, depths, test.want_ids, test.want_depth)
+		}
+	}
+}
+
+func TestFindReplyParent(t *testing.T) {
+
+	cfg := default_config()
+	cfg.ServerURL = "gemini://gemthread.example/gemthread"
+	set_config(cfg, nil)
+
+	db, err := db_open(filepath.Join(t.TempDir(), "gemthread.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	new_thread := func(page string) (int64, GemThreadMessage) {
+		thr_id, err := db_create_new_thread(db, GemThreadMessage{url: page, author: "a", title: page})
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := db_find_existing_message_by_url(db, page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return thr_id, msg
+	}
+
+	add_response := func(thr_id int64, page string) GemThreadMessage {
+		_, err := db_insert_response_message(db, thr_id, GemThreadMessage{url: page, author: "b", title: page}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := db_find_existing_message_by_url(db, page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+
+	thr_id, origin := new_thread("gemini://a.example/post.gmi")
+	first := add_response(thr_id, "gemini://b.example/first.gmi")
+	second := add_response(thr_id, "gemini://c.example/dir/second.gmi")
+
+	other_thr_id, _ := new_thread("gemini://d.example/other.gmi")
+	elsewhere := add_response(other_thr_id, "gemini://e.example/elsewhere.gmi")
+
+	thread_url := fmt.Sprintf("%s/threads/%d", server_url(), thr_id)
+	message_url := func(msg GemThreadMessage) string {
+		return fmt.Sprintf("%s/messages/%d", server_url(), msg.id)
+	}
+
+	// A new page, not yet in the thread
+	page := GemThreadMessage{url: "gemini://f.example/reply.gmi"}
+
+	tests := []struct {
+		name     string
+		msg      GemThreadMessage
+		reply_to string
+		links    []string
+		want     int64
+	}{
+		{"no links", page, "", nil, 0},
+		{"a link to a response", page, "", []string{first.url}, first.id},
+		{"the first link to a response is used", page, "", []string{origin.url, second.url, first.url}, second.id},
+		{"a link to a response's message page", page, "", []string{message_url(first)}, first.id},
+		{"a link to the thread", page, "", []string{thread_url}, 0},
+		{"a link to the post that started the thread", page, "", []string{origin.url}, 0},
+		{"a link to a response in another thread", page, "", []string{elsewhere.url}, 0},
+		{"a link to a page not in the thread", page, "", []string{"gemini://g.example/"}, 0},
+		{"ReplyTo is used before the links", page, second.url, []string{first.url}, second.id},
+		{"ReplyTo naming the thread replies to the thread", page, thread_url, []string{first.url}, 0},
+		{"ReplyTo naming a page not in the thread falls back to the links", page, "gemini://g.example/", []string{first.url}, first.id},
+		{"a relative ReplyTo is resolved against the page", GemThreadMessage{url: "gemini://c.example/dir/new.gmi"}, "second.gmi", nil, second.id},
+		{"ReplyTo with a fragment", page, first.url + "#comment", nil, first.id},
+		{"a response does not reply to itself through ReplyTo", second, second.url, []string{first.url}, first.id},
+		{"a response does not reply to itself through a link", second, "", []string{second.url, message_url(second), first.url}, first.id},
+	}
+
+	for _, test := range tests {
+		msg := test.msg
+		msg.reply_to = test.reply_to
+		got, err := find_reply_parent(db, thr_id, msg, test.links)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: got parent %d, want %d", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// A response submitted to /respond, rather than to a thread's respond URL, is added to
+// every thread that it links to. A link to a thread matches that thread. A link to a
+// message, either to its page or to its page on this server, matches the thread that
+// the message started or, if it did not start one, the threads that it responds to. A
+// link to a message that responds to more than one thread is ambiguous unless another
+// link matches one of those threads, and the submitter is then asked to choose.
+
+// An ambiguous_response_error lists the threads that the submitter of an ambiguous
+// response may choose from.
+type ambiguous_response_error struct {
+	candidates []int64
+}
+
+func (e ambiguous_response_error) Error() string {
+	return "the page links to messages that are in more than one thread"
+}
+
+// Returns the ID in a link to one of this server's threads or messages, such as
+// gemini://hostname.xyz/gemthread/threads/<THREAD_ID>, or 0 if the link is not to the
+// given collection.
+func local_link_id(link string, collection string) int64 {
+
+	prefix := strings.TrimSuffix(server_url(), "/") + "/" + collection + "/"
+	if !strings.HasPrefix(link, prefix) {
+		return 0
+	}
+
+	id_str := strings.TrimPrefix(link, prefix)
+	if i := strings.IndexAny(id_str, "/?"); i >= 0 {
+		id_str = id_str[:i]
+	}
+
+	id, err := strconv.ParseInt(id_str, 10, 64)
+	if err != nil {
+		return 0
+	}
+
+	return id
+}
+
+// Returns the IDs of the thread that a message started and of the threads that it
+// responds to.
+func message_thread_ids(db *sql.DB, msg_id int64) (int64, []int64, error) {
+
+	origin, err := db_find_thread_by_originating_message_id(db, msg_id)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	thrs, err := db_find_threads_by_responding_message_id(db, msg_id)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var thr_ids []int64
+	for _, thr := range thrs {
+		thr_ids = append_thread_id(thr_ids, thr.id)
+	}
+
+	return origin.id, thr_ids, nil
+}
+
+func has_thread_id(thr_ids []int64, thr_id int64) bool {
+	for _, id := range thr_ids {
+		if id == thr_id {
+			return true
+		}
+	}
+	return false
+}
+
+func append_thread_id(thr_ids []int64, thr_id int64) []int64 {
+	if has_thread_id(thr_ids, thr_id) {
+		return thr_ids
+	}
+	return append(thr_ids, thr_id)
+}
+
+// Returns the threads that a link matches.
+func link_thread_ids(db *sql.DB, link string) ([]int64, error) {
+
+	if thr_id := local_link_id(link, "threads"); thr_id > 0 {
+		thr, err := db_find_thread_by_id(db, thr_id)
+		if err != nil || thr.id == 0 {
+			return nil, err
+		}
+		return []int64{thr.id}, nil
+	}
+
+	msg_id := local_link_id(link, "messages")
+	if msg_id == 0 {
+		msg, err := db_find_existing_message_by_url(db, link)
+		if err != nil || msg.url != link {
+			return nil, err
+		}
+		msg_id = msg.id
+	}
+
+	origin_id, thr_ids, err := message_thread_ids(db, msg_id)
+	if err != nil {
+		return nil, err
+	}
+
+	if origin_id > 0 {
+		return []int64{origin_id}, nil
+	}
+
+	return thr_ids, nil
+}
+
+// Adds msg as a response to the threads that the links on its page match, and returns
+// the IDs of those threads, including any that it was already in. Returns an
+// ambiguous_response_error if the links do not say which thread it responds to.
+func add_linked_response(db *sql.DB, msg GemThreadMessage, links []string) ([]int64, error) {
+
+	// Threads that the page already belongs to
+	var member_ids []int64
+
+	existing, err := db_find_existing_message_by_url(db, msg.url)
+	if err != nil {
+		return nil, err
+	}
+	if existing.url == msg.url {
+		origin_id, thr_ids, err := message_thread_ids(db, existing.id)
+		if err != nil {
+			return nil, err
+		}
+		member_ids = append(thr_ids, origin_id)
+	}
+
+	var matched_ids []int64
+	var ambiguous [][]int64
+
+	for _, link := range links {
+
+		if link == msg.url {
+			continue
+		}
+
+		thr_ids, err := link_thread_ids(db, link)
+		if err != nil {
+			return nil, err
+		}
+
+		switch len(thr_ids) {
+		case 0:
+		case 1:
+			matched_ids = append_thread_id(matched_ids, thr_ids[0])
+		default:
+			ambiguous = append(ambiguous, thr_ids)
+		}
+	}
+
+	// A link is not ambiguous if another link matches one of its threads, or if the
+	// page is already in one of them
+	var candidate_ids []int64
+	for _, thr_ids := range ambiguous {
+		resolved := false
+		for _, thr_id := range thr_ids {
+			resolved = resolved || has_thread_id(matched_ids, thr_id) || has_thread_id(member_ids, thr_id)
+		}
+		if !resolved {
+			for _, thr_id := range thr_ids {
+				candidate_ids = append_thread_id(candidate_ids, thr_id)
+			}
+		}
+	}
+
+	if len(candidate_ids) > 0 {
+		for _, thr_id := range matched_ids {
+			candidate_ids = append_thread_id(candidate_ids, thr_id)
+		}
+		return nil, ambiguous_response_error{candidate_ids}
+	}
+
+	if len(matched_ids) == 0 {
+		return nil, rejected_error{"the page does not link to any thread or message on this GemThread server; to respond to a thread that it does not link to, use the thread's respond link"}
+	}
+
+	// Threads that require backlinks are checked before the response is added to any
+	var new_ids []int64
+	for _, thr_id := range matched_ids {
+		if has_thread_id(member_ids, thr_id) {
+			continue
+		}
+		// The page matched a thread through its links, so it is gemtext
+		err = check_backlink(db, thr_id, "text/gemini", links)
+		if err != nil {
+			return nil, err
+		}
+		new_ids = append(new_ids, thr_id)
+	}
+
+	for _, thr_id := range new_ids {
+
+		parent_id, err := find_reply_parent(db, thr_id, msg, links)
+		if err != nil {
+			return nil, errors.New("unable to find the response that the page replies to: " + err.Error())
+		}
+
+		_, err = db_insert_response_message(db, thr_id, msg, parent_id)
+		if err != nil {
+			return nil, errors.New("unable to insert message: " + err.Error())
+		}
+	}
+
+	return matched_ids, nil
+}
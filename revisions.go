@@ -0,0 +1,291 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Each time a refetch finds that a page has changed, the message's previous author,
+// title and summary are recorded in the message_revisions table, along with the hash
+// and, when snapshots are enabled, the body of the previous copy of the page. The hash
+// of the latest copy of each page is kept in the message_hashes table whether or not
+// snapshots are enabled, so that changes to the text are always noticed. The history
+// page lists the revisions with a line diff of what changed.
+
+type GemThreadMessageRevision struct {
+	id           int64
+	messages_id  int64
+	author       string
+	title        string
+	summary      string
+	content_hash string
+	// Empty unless snapshots were enabled
+	body       string
+	dt_created string
+}
+
+func content_hash(body string) string {
+	sum := sha256.Sum256([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
+
+// Records the hash of the copy of a message's page that was just fetched.
+func save_page_hash(db *sql.DB, msg_id int64, page fetched_page) error {
+	return db_save_message_hash(db, msg_id, content_hash(page.body))
+}
+
+// Records the previous version of a message that a refetch found to have changed, and
+// updates the message to match the retrieved version. prev_hash is the hash of the
+// previous copy of the page, and prev_snap is that copy, if snapshots are enabled.
+func save_message_revision(db *sql.DB, saved_msg GemThreadMessage, retrieved_msg GemThreadMessage, prev_hash string, prev_snap GemThreadSnapshot) error {
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = db_insert_message_revision(tx, GemThreadMessageRevision{
+		messages_id:  saved_msg.id,
+		author:       saved_msg.author,
+		title:        saved_msg.title,
+		summary:      saved_msg.summary,
+		content_hash: prev_hash,
+		body:         prev_snap.body,
+	})
+	if err != nil {
+		return err
+	}
+
+	saved_msg.author = retrieved_msg.author
+	saved_msg.title = retrieved_msg.title
+	saved_msg.summary = retrieved_msg.summary
+
+	_, err = db_update_message(db, saved_msg, tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Diffs larger than this, in lines before times lines after, are shown as the whole
+// of the old text removed and the whole of the new text added. Anyone may ask for a
+// history page, so this keeps the table that each diff needs small; lines common to
+// the start and end of both texts do not count.
+const max_diff_size = 40000
+
+// Lines of unchanged text shown around each change
+const diff_context = 2
+
+// Returns a line diff of old and new. Each line of the result starts with "- " if it
+// was removed, "+ " if it was added, or "  " if it is unchanged context. Runs of
+// unchanged lines are elided.
+func line_diff(old_text string, new_text string) []string {
+
+	a := diff_lines(old_text)
+	b := diff_lines(new_text)
+
+	// Lines common to the start and end of both need not be compared
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var lines []string
+	for _, line := range a[:prefix] {
+		lines = append(lines, "  "+line)
+	}
+	lines = append(lines, diff_middle(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for _, line := range a[len(a)-suffix:] {
+		lines = append(lines, "  "+line)
+	}
+
+	return elide_context(lines)
+}
+
+// Splits text into lines. Empty text has no lines, rather than one empty line.
+func diff_lines(text string) []string {
+	text = strings.TrimRight(text, "\n")
+	if len(text) == 0 {
+		return nil
+	}
+	return strings.Split(text, "\n")
+}
+
+// Diffs two runs of lines by finding their longest common subsequence.
+func diff_middle(a []string, b []string) []string {
+
+	var lines []string
+
+	if len(a)*len(b) > max_diff_size {
+		for _, line := range a {
+			lines = append(lines, "- "+line)
+		}
+		for _, line := range b {
+			lines = append(lines, "+ "+line)
+		}
+		return lines
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if a[i] == b[j] {
+			lines = append(lines, "  "+a[i])
+			i++
+			j++
+		} else if lcs[i+1][j] >= lcs[i][j+1] {
+			lines = append(lines, "- "+a[i])
+			i++
+		} else {
+			lines = append(lines, "+ "+b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		lines = append(lines, "- "+a[i])
+	}
+	for ; j < len(b); j++ {
+		lines = append(lines, "+ "+b[j])
+	}
+
+	return lines
+}
+
+// Drops unchanged lines that are more than diff_context lines from a change.
+func elide_context(lines []string) []string {
+
+	keep := make([]bool, len(lines))
+	for i, line := range lines {
+		if strings.HasPrefix(line, "  ") {
+			continue
+		}
+		for k := i - diff_context; k <= i+diff_context; k++ {
+			if k >= 0 && k < len(lines) {
+				keep[k] = true
+			}
+		}
+	}
+
+	var elided []string
+	skipped := false
+	for i, line := range lines {
+		if keep[i] {
+			elided = append(elided, line)
+			skipped = false
+		} else if !skipped {
+			elided = append(elided, "  …")
+			skipped = true
+		}
+	}
+
+	return elided
+}
+
+// Renders a diff as a preformatted block.
+func diff_block(alt_text string, lines []string) string {
+	rstr := "```" + alt_text + "\r\n"
+	for _, line := range lines {
+		rstr += strings.TrimRight(line, "\r") + "\r\n"
+	}
+	rstr += "```\r\n"
+	return rstr
+}
+
+// Describes how a message changed from one version to the next.
+func revision_change_string(before GemThreadMessageRevision, after GemThreadMessageRevision) string {
+
+	rstr := "## Changed " + before.dt_created + "\r\n"
+
+	if before.author != after.author {
+		rstr += "Author: " + before.author + " → " + after.author + "\r\n"
+	}
+	if before.title != after.title {
+		rstr += "Title: " + before.title + " → " + after.title + "\r\n"
+	}
+	if before.summary != after.summary {
+		rstr += "Summary:\r\n"
+		rstr += diff_block("diff of summary", line_diff(before.summary, after.summary))
+	}
+	// Revisions recorded before page hashes were kept have no hash
+	if len(before.content_hash) > 0 && len(after.content_hash) > 0 && before.content_hash != after.content_hash {
+		if len(before.body) > 0 && len(after.body) > 0 {
+			rstr += "Page:\r\n"
+			rstr += diff_block("diff of page", line_diff(before.body, after.body))
+		} else {
+			rstr += "The page's content changed.\r\n"
+		}
+	}
+
+	return rstr
+}
+
+// Returns the history page for a message: each of its revisions, newest first, with
+// what changed in it.
+func history_string(db *sql.DB, msg GemThreadMessage) (string, error) {
+
+	revs, err := db_find_message_revisions(db, msg.id)
+	if err != nil {
+		return "", err
+	}
+
+	rstr := fmt.Sprintf("# History of message %d\r\n", msg.id)
+	rstr += msg.String()
+
+	if len(revs) == 0 {
+		rstr += "This message has not changed since it was added.\r\n"
+	}
+
+	// The current version, which the newest revision changed into
+	current := GemThreadMessageRevision{
+		messages_id: msg.id,
+		author:      msg.author,
+		title:       msg.title,
+		summary:     msg.summary,
+	}
+	current.content_hash, err = db_find_message_hash(db, msg.id)
+	if err != nil {
+		return "", err
+	}
+	snap, err := db_find_snapshot(db, msg.id)
+	if err != nil {
+		return "", err
+	}
+	if snap.messages_id > 0 && snap.content_hash == current.content_hash {
+		current.body = snap.body
+	}
+
+	after := current
+	for i := len(revs) - 1; i >= 0; i-- {
+		rstr += revision_change_string(revs[i], after)
+		after = revs[i]
+	}
+
+	rstr += fmt.Sprintf("=> %s/messages/%d About this message\r\n", server_url(), msg.id)
+
+	return rstr, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLineDiff(t *testing.T) {
+
+	// Texts too large to diff line by line
+	var big_old, big_new, big_want []string
+	for i := 0; i < 201; i++ {
+		big_old = append(big_old, fmt.Sprintf("old %d", i))
+		big_new = append(big_new, fmt.Sprintf("new %d", i))
+	}
+	for _, line := range big_old {
+		big_want = append(big_want, "- "+line)
+	}
+	for _, line := range big_new {
+		big_want = append(big_want, "+ "+line)
+	}
+
+	tests := []struct {
+		name     string
+		old_text string
+		new_text string
+		want     []string
+	}{
+		{
+			name:     "unchanged text is elided",
+			old_text: "a\nb\nc",
+			new_text: "a\nb\nc",
+			want:     []string{"  …"},
+		},
+		{
+			name:     "a trailing newline is not a change",
+			old_text: "a\nb\n",
+			new_text: "a\nb",
+			want:     []string{"  …"},
+		},
+		{
+			name:     "a changed line is shown with its context",
+			old_text: "a\nb\nc\nd\ne\nf\ng",
+			new_text: "a\nb\nc\nD\ne\nf\ng",
+			want:     []string{"  …", "  b", "  c", "- d", "+ D", "  e", "  f", "  …"},
+		},
+		{
+			name:     "a line added at the end",
+			old_text: "a\nb",
+			new_text: "a\nb\nc",
+			want:     []string{"  a", "  b", "+ c"},
+		},
+		{
+			name:     "a line removed from the start",
+			old_text: "x\na\nb",
+			new_text: "a\nb",
+			want:     []string{"- x", "  a", "  b"},
+		},
+		{
+			name:     "the common end does not overlap the common start",
+			old_text: "a\na",
+			new_text: "a\na\na",
+			want:     []string{"  a", "  a", "+ a"},
+		},
+		{
+			name:     "lines common to the middle are kept",
+			old_text: "a\nx\nb\ny\nc",
+			new_text: "a\nb\nc",
+			want:     []string{"  a", "- x", "  b", "- y", "  c"},
+		},
+		{
+			name:     "separate changes are elided between",
+			old_text: "1\n2\n3\n4\n5\n6\n7\n8",
+			new_text: "one\n2\n3\n4\n5\n6\n7\neight",
+			want:     []string{"- 1", "+ one", "  2", "  3", "  …", "  6", "  7", "- 8", "+ eight"},
+		},
+		{
+			name:     "text added to empty text",
+			old_text: "",
+			new_text: "new",
+			want:     []string{"+ new"},
+		},
+		{
+			name:     "text removed entirely",
+			old_text: "old",
+			new_text: "",
+			want:     []string{"- old"},
+		},
+		{
+			name:     "texts too large to diff are replaced whole",
+			old_text: strings.Join(big_old, "\n"),
+			new_text: strings.Join(big_new, "\n"),
+			want:     big_want,
+		},
+	}
+
+	for _, test := range tests {
+		got := line_diff(test.old_text, test.new_text)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"git.sr.ht/~adnano/go-gemini"
+)
+
+// Support for robots.txt as described in the Gemini robots.txt companion
+// specification. gemthread obeys the rules for "User-agent: *" and for each of the
+// virtual agent names in the fetcher's robots_user_agents setting.
+
+type robots_rule struct {
+	allow  bool
+	prefix string
+}
+
+type robots_rules struct {
+	rules      []robots_rule
+	dt_fetched time.Time
+}
+
+// A robots_error is returned when robots.txt disallows fetching a URL.
+type robots_error struct {
+	url string
+}
+
+func (e robots_error) Error() string {
+	return "the owner of this capsule has asked automated agents not to fetch " + e.url + " (see robots.txt)"
+}
+
+var _robots_cache = make(map[string]robots_rules)
+var _robots_cache_lock sync.Mutex
+
+// Parses robots.txt and returns the rules that apply to the given user agents.
+func parse_robots(robots_text string, agents []string) []robots_rule {
+
+	var rules []robots_rule
+
+	applies := false
+	in_agent_lines := false
+
+	for _, line := range strings.Split(robots_text, "\n") {
+
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		field := strings.ToLower(strings.TrimSpace(parts[0]))
+		value := strings.TrimSpace(parts[1])
+
+		switch field {
+		case "user-agent":
+			// Consecutive User-agent lines share the rules that follow them
+			if !in_agent_lines {
+				applies = false
+			}
+			in_agent_lines = true
+			if value == "*" {
+				applies = true
+			}
+			for _, agent := range agents {
+				if strings.EqualFold(value, agent) {
+					applies = true
+				}
+			}
+		case "disallow", "allow":
+			in_agent_lines = false
+			// An empty Disallow line disallows nothing
+			if applies && len(value) > 0 {
+				rules = append(rules, robots_rule{allow: field == "allow", prefix: value})
+			}
+		default:
+			in_agent_lines = false
+		}
+	}
+
+	return rules
+}
+
+// Reports whether the rules allow path. The longest matching rule wins, so that an
+// Allow line can make an exception to a broader Disallow line.
+func robots_allows(rules []robots_rule, path string) bool {
+
+	if len(path) == 0 {
+		path = "/"
+	}
+
+	allowed := true
+	longest := -1
+
+	for _, rule := range rules {
+		if strings.HasPrefix(path, rule.prefix) && len(rule.prefix) > longest {
+			allowed = rule.allow
+			longest = len(rule.prefix)
+		}
+	}
+
+	return allowed
+}
+
+// Fetches robots.txt for the host of u, following redirects. A capsule without a
+// robots.txt, or whose robots.txt cannot be read, has no rules. The rules are not to
+// be cached if the failure may be temporary.
+func fetch_robots(ctx context.Context, client *gemini.Client, u *url.URL) ([]robots_rule, bool) {
+
+	robots_url := &url.URL{Scheme: "gemini", Host: u.Host, Path: "/robots.txt"}
+
+	ctx, cancel := context.WithTimeout(ctx, config().Fetcher.HeaderTimeout.Duration+config().Fetcher.BodyTimeout.Duration)
+	defer cancel()
+
+	for redirects := 0; ; redirects++ {
+
+		req, err := gemini.NewRequest(robots_url.String())
+		if err != nil {
+			return nil, false
+		}
+
+		charge_host_fetch(robots_url.Hostname())
+
+		resp, err := client.Do(ctx, req)
+		if err != nil {
+			// Do not cache: the host may only be temporarily unreachable
+			return nil, false
+		}
+		stop := close_when_done(ctx, resp.Body)
+
+		switch resp.Status.Class() {
+
+		case gemini.StatusSuccess:
+			robots_body, err := read_body(io.LimitReader(resp.Body, 64*1024))
+			stop()
+			resp.Body.Close()
+			if err != nil {
+				return nil, false
+			}
+			return parse_robots(string(robots_body), config().Fetcher.RobotsUserAgents), true
+
+		case gemini.StatusRedirect:
+			stop()
+			resp.Body.Close()
+			// Like any other robots.txt that cannot be read, one behind too many
+			// redirects has no rules
+			if redirects >= config().Fetcher.MaxRedirects {
+				return nil, true
+			}
+			target, err := url.Parse(resp.Meta)
+			if err != nil {
+				return nil, true
+			}
+			robots_url = robots_url.ResolveReference(target)
+			// A robots.txt that is not served over Gemini is not one
+			if robots_url.Scheme != "gemini" {
+				return nil, true
+			}
+
+		default:
+			stop()
+			resp.Body.Close()
+			return nil, resp.Status.Class() != gemini.StatusTemporaryFailure
+		}
+	}
+}
+
+// Checks u against its host's robots.txt, which is fetched once and then cached
+// for the fetcher's robots_cache_time.
+func check_robots(ctx context.Context, client *gemini.Client, u *url.URL) error {
+
+	if !config().Fetcher.ObeyRobots {
+		return nil
+	}
+
+	host := strings.ToLower(u.Host)
+	cache_time := config().Fetcher.RobotsCacheTime.Duration
+
+	_robots_cache_lock.Lock()
+	cached, ok := _robots_cache[host]
+	_robots_cache_lock.Unlock()
+
+	if !ok || time.Since(cached.dt_fetched) > cache_time {
+		rules, cacheable := fetch_robots(ctx, client, u)
+		cached = robots_rules{rules: rules, dt_fetched: time.Now()}
+		if cacheable {
+			_robots_cache_lock.Lock()
+			if len(_robots_cache) >= host_limits_prune_size {
+				for k, v := range _robots_cache {
+					if time.Since(v.dt_fetched) > cache_time {
+						delete(_robots_cache, k)
+					}
+				}
+			}
+			_robots_cache[host] = cached
+			_robots_cache_lock.Unlock()
+		}
+	}
+
+	if !robots_allows(cached.rules, u.EscapedPath()) {
+		return robots_error{url: u.String()}
+	}
+
+	return nil
+}
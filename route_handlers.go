@@ -2,52 +2,101 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net/url"
-	"os"
 	"strconv"
 	"strings"
-	"text/template"
+	"time"
 )
 
-func handle_help(fd io.ReadWriteCloser) {
+// Reports whether the URL's host, or a domain that it belongs to, is listed in the
+// moderation blocked_hosts setting.
+func is_blocked_url(tgt_url string) bool {
 
-	// Fail if file does not exist or perms aren't right
-	info, err := os.Stat(help_path())
-	if os.IsNotExist(err) || os.IsPermission(err) {
-		write_response(fd, 51, "help file not found")
-		return
-	} else if err != nil {
-		write_response(fd, 40, "temporary failure for help file")
-		return
-	} else if uint64(info.Mode().Perm())&0444 != 0444 {
-		write_response(fd, 51, "help file not found")
-		return
+	u, err := url.Parse(tgt_url)
+	if err != nil {
+		return false
 	}
 
-	help_data, err := ioutil.ReadFile(help_path())
-	if err != nil {
-		write_response(fd, 50, "error reading help file")
+	host := strings.ToLower(u.Hostname())
+
+	for _, blocked := range config().Moderation.BlockedHosts {
+		blocked = strings.ToLower(strings.TrimSpace(blocked))
+		if len(blocked) == 0 {
+			continue
+		}
+		if host == blocked || strings.HasSuffix(host, "."+blocked) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Describes why a page could not be added, for the person who submitted it.
+func submission_error_message(tgt_url string, err error) string {
+
+	var robots_err robots_error
+	if errors.As(err, &robots_err) {
+		return "DISALLOWED: " + robots_err.Error()
+	}
+
+	var rejected_err rejected_error
+	if errors.As(err, &rejected_err) {
+		return rejected_err.Error()
+	}
+
+	return "unable to retrieve " + tgt_url + ": " + err.Error()
+}
+
+// Tells the person who submitted a page why it could not be added. A submission or
+// fetch refused by the rate limits is answered with 44 SLOW DOWN and the number of
+// seconds to wait before trying again.
+func write_submission_error(fd io.ReadWriteCloser, tgt_url string, err error) {
+
+	var slow_down_err slow_down_error
+	if errors.As(err, &slow_down_err) {
+		write_response(fd, 44, strconv.Itoa(slow_down_err.wait_seconds()))
 		return
 	}
 
-	help_string := string(help_data)
+	write_response(fd, 50, submission_error_message(tgt_url, err))
+}
+
+func handle_help(fd io.ReadWriteCloser) {
+
+	t := help_template()
+	if t == nil {
+		write_response(fd, 51, "help file not found")
+		return
+	}
 
 	type server_info struct {
-		ServerURL string
+		ServerURL        string
+		RobotsUserAgents string
+		// Empty if messages are not refreshed
+		RefreshInterval string
 	}
 
 	sinfo := server_info{
-		ServerURL: server_url(),
+		ServerURL:        server_url(),
+		RobotsUserAgents: strings.Join(config().Fetcher.RobotsUserAgents, ", "),
 	}
 
-	t, err := template.New("help").Parse(help_string)
-	if err != nil {
-		write_response(fd, 50, "error while parsing help file template: "+err.Error())
-		return
+	if config().Refresh.Enabled {
+		interval := config().Refresh.Interval.Duration
+		switch {
+		case interval == time.Hour:
+			sinfo.RefreshInterval = "about once an hour"
+		case interval%time.Hour == 0:
+			sinfo.RefreshInterval = fmt.Sprintf("about once every %d hours", interval/time.Hour)
+		default:
+			sinfo.RefreshInterval = "about once every " + interval.String()
+		}
 	}
 
 	var tpl bytes.Buffer
@@ -64,10 +113,14 @@ func handle_help(fd io.ReadWriteCloser) {
 // handle_threads handles URLs of the following forms:
 // => gemini://hostname.xyz/gemthread/threads
 // => gemini://hostname.xyz/gemthread/threads?start=0&count=100&sort=CREATE
+// => gemini://hostname.xyz/gemthread/threads/feed.atom
+// => gemini://hostname.xyz/gemthread/threads/subscribe
 // => gemini://hostname.xyz/gemthread/threads/new?<URL_ENCODED_URL>
 // => gemini://hostname.xyz/gemthread/threads/<THREAD_ID>
+// => gemini://hostname.xyz/gemthread/threads/<THREAD_ID>/feed.atom
+// => gemini://hostname.xyz/gemthread/threads/<THREAD_ID>/subscribe
 // => gemini://hostname.xyz/gemthread/threads/<THREAD_ID>/respond?<URL_ENCODED_URL>
-func handle_threads(fd io.ReadWriteCloser, db *sql.DB, pathcomps []string, query_string string) {
+func handle_threads(ctx context.Context, fd io.ReadWriteCloser, db *sql.DB, client string, pathcomps []string, query_string string) {
 
 	if len(pathcomps) == 1 {
 		// URL is gemini://hostname.xyz/gemthread/threads
@@ -147,11 +200,40 @@ func handle_threads(fd io.ReadWriteCloser, db *sql.DB, pathcomps []string, query
 		}
 
 		rtxt += fmt.Sprintf("=> %s/threads/new Create a new thread\r\n", server_url())
+		rtxt += fmt.Sprintf("=> %s/respond Respond to the threads that your page links to\r\n", server_url())
+		rtxt += fmt.Sprintf("=> %s/threads/subscribe Subscribe to new threads and responses\r\n", server_url())
+		rtxt += fmt.Sprintf("=> %s/threads/feed.atom Subscribe to new threads and responses (Atom feed)\r\n", server_url())
 
 		write_response(fd, 20, rtxt)
 		return
 	}
 
+	if pathcomps[1] == "feed.atom" && len(pathcomps) == 2 {
+		// URL is gemini://hostname.xyz/gemthread/threads/feed.atom
+
+		feed, err := threads_feed(db)
+		if err != nil {
+			write_response(fd, 50, "error while building feed: "+err.Error())
+			return
+		}
+
+		write_document(fd, atom_media_type, feed)
+		return
+	}
+
+	if pathcomps[1] == "subscribe" && len(pathcomps) == 2 {
+		// URL is gemini://hostname.xyz/gemthread/threads/subscribe
+
+		page, err := threads_subscribe_page(db)
+		if err != nil {
+			write_response(fd, 50, "error while building subscription page: "+err.Error())
+			return
+		}
+
+		write_response(fd, 20, page)
+		return
+	}
+
 	if pathcomps[1] == "new" {
 		// URL is gemini://hostname.xyz/gemthread/threads/new?<URL_ENCODED_URL>
 
@@ -171,34 +253,24 @@ func handle_threads(fd io.ReadWriteCloser, db *sql.DB, pathcomps []string, query
 			return
 		}
 
-		result, err := retrieve(tgt_url)
-		if err != nil {
-			write_response(fd, 50, "unable to retrieve "+tgt_url+": "+err.Error())
+		if is_blocked_url(tgt_url) {
+			write_response(fd, 50, "pages from this host may not be added to this GemThreads server")
 			return
 		}
 
-		msg, is_allowed, err := parse_post(tgt_url, result)
+		err = reserve_submission(client, submission_thread)
 		if err != nil {
-			write_response(fd, 50, "unable to parse "+tgt_url+" contents: "+err.Error())
-			return
-		}
-
-		if !is_allowed {
-			write_response(fd, 50, "PROHIBITED: the requested page contains \"GemThread.Prohibit\"")
+			write_submission_error(fd, tgt_url, err)
 			return
 		}
 
-		thr_id, err := db_create_new_thread(db, msg)
-
+		sub_id, err := queue_submission(db, submission_thread, tgt_url, 0)
 		if err != nil {
-			if thr_id < 0 {
-				write_response(fd, 50, err.Error())
-				return
-			}
-			// Otherwise, this is a pre-existing thread, and we simply continue.
+			write_response(fd, 50, "unable to queue submission: "+err.Error())
+			return
 		}
 
-		write_response(fd, 30, fmt.Sprintf("%s/threads/%d", server_url(), thr_id))
+		write_response(fd, 30, fmt.Sprintf("%s/submissions/%d", server_url(), sub_id))
 
 		return
 	}
@@ -220,10 +292,12 @@ func handle_threads(fd io.ReadWriteCloser, db *sql.DB, pathcomps []string, query
 		// => gemini://hostname.xyz/gemthread/threads/<THREAD_ID>
 		// => gemini://hostname.xyz/gemthread/threads/<THREAD_ID>?order=descending
 		// => gemini://hostname.xyz/gemthread/threads/<THREAD_ID>?order=ascending
+		// => gemini://hostname.xyz/gemthread/threads/<THREAD_ID>?view=flat
 
 		// So, the user wants to view the thread
 
 		ascending := true // order is ascending by default
+		flat := false     // replies are shown as a tree by default
 
 		if len(query_string) > 0 {
 			query_map, err := parse_query_string_to_map(query_string)
@@ -243,6 +317,18 @@ func handle_threads(fd io.ReadWriteCloser, db *sql.DB, pathcomps []string, query
 					return
 				}
 			}
+
+			q_view := query_map["view"]
+			if len(q_view) > 0 {
+				if strings.HasPrefix(strings.ToUpper(q_view), "F") {
+					flat = true
+				} else if strings.HasPrefix(strings.ToUpper(q_view), "T") {
+					flat = false
+				} else {
+					write_response(fd, 50, "error in 'view' parameter: "+q_view)
+					return
+				}
+			}
 		}
 
 		thr, err := db_find_thread_by_id(db, int64(thr_id))
@@ -251,17 +337,73 @@ func handle_threads(fd io.ReadWriteCloser, db *sql.DB, pathcomps []string, query
 			return
 		}
 
+		if thr.id == 0 {
+			write_response(fd, 51, fmt.Sprintf("thread %d not found", thr_id))
+			return
+		}
+
 		msgs, err := db_find_messages_for_thread(db, int64(thr_id), ascending)
 		if err != nil {
 			write_response(fd, 50, "error while finding messages for thread: "+err.Error())
 			return
 		}
 
+		unreachable, err := db_find_unreachable_messages_for_thread(db, int64(thr_id))
+		if err != nil {
+			write_response(fd, 50, "error while checking thread messages: "+err.Error())
+			return
+		}
+
+		revised, err := db_find_revised_messages_for_thread(db, int64(thr_id))
+		if err != nil {
+			write_response(fd, 50, "error while checking thread messages: "+err.Error())
+			return
+		}
+
+		depths := make([]int, len(msgs))
+		if !flat {
+			parents, err := db_find_reply_parents_for_thread(db, int64(thr_id))
+			if err != nil {
+				write_response(fd, 50, "error while finding replies in thread: "+err.Error())
+				return
+			}
+			msgs, depths = reply_tree(msgs, parents)
+		}
+
 		rstr := fmt.Sprintf("# %s — %s\r\n", thr.author, thr.title)
-		for _, msg := range msgs {
-			rstr += msg.String()
+		for i, msg := range msgs {
+			// The message that started the thread has an ID of zero if it has been removed
+			if msg.id == 0 {
+				rstr += "The original post has been removed.\r\n"
+				continue
+			}
+			rstr += msg.TreeString(depths[i])
+			if dt_revised, ok := revised[msg.id]; ok {
+				rstr += fmt.Sprintf("=> %s/messages/%d/history Edited %s\r\n", server_url(), msg.id, dt_revised)
+			}
+			if dt_unreachable, ok := unreachable[msg.id]; ok {
+				rstr += "This page has been unreachable since " + dt_unreachable + "\r\n"
+				if config().Snapshots.Enabled {
+					rstr += fmt.Sprintf("=> %s/messages/%d/archive Archived copy\r\n", server_url(), msg.id)
+				}
+			}
+		}
+		requires_backlinks, err := thread_requires_backlinks(db, int64(thr_id))
+		if err != nil {
+			write_response(fd, 50, "error while checking thread policy: "+err.Error())
+			return
+		}
+		if requires_backlinks {
+			rstr += "Responses to this thread must link to it, or to the post that started it.\r\n"
 		}
 		rstr += fmt.Sprintf("=> %s/threads/%d/respond Add a response to this thread\r\n", server_url(), thr_id)
+		if flat {
+			rstr += fmt.Sprintf("=> %s/threads/%d Show who replied to whom\r\n", server_url(), thr_id)
+		} else {
+			rstr += fmt.Sprintf("=> %s/threads/%d?view=flat Show the responses in the order that they were added\r\n", server_url(), thr_id)
+		}
+		rstr += fmt.Sprintf("=> %s/threads/%d/subscribe Subscribe to this thread\r\n", server_url(), thr_id)
+		rstr += fmt.Sprintf("=> %s/threads/%d/feed.atom Subscribe to this thread (Atom feed)\r\n", server_url(), thr_id)
 		rstr += fmt.Sprintf("=> %s/threads/ See all threads\r\n", server_url())
 
 		write_response(fd, 20, rstr)
@@ -269,6 +411,43 @@ func handle_threads(fd io.ReadWriteCloser, db *sql.DB, pathcomps []string, query
 		return
 	}
 
+	// URL is of the form:
+	// => gemini://hostname.xyz/gemthread/threads/<THREAD_ID>/feed.atom
+	// => gemini://hostname.xyz/gemthread/threads/<THREAD_ID>/subscribe
+	if pathcomps[2] == "feed.atom" || pathcomps[2] == "subscribe" {
+
+		thr, err := db_find_thread_by_id(db, int64(thr_id))
+		if err != nil {
+			write_response(fd, 50, "error while retrieving thread: "+err.Error())
+			return
+		}
+
+		if thr.id == 0 {
+			write_response(fd, 51, fmt.Sprintf("thread %d not found", thr_id))
+			return
+		}
+
+		if pathcomps[2] == "subscribe" {
+			page, err := thread_subscribe_page(db, thr)
+			if err != nil {
+				write_response(fd, 50, "error while building subscription page: "+err.Error())
+				return
+			}
+
+			write_response(fd, 20, page)
+			return
+		}
+
+		feed, err := thread_feed(db, thr)
+		if err != nil {
+			write_response(fd, 50, "error while building feed: "+err.Error())
+			return
+		}
+
+		write_document(fd, atom_media_type, feed)
+		return
+	}
+
 	// URL should be of the form:
 	// => gemini://hostname.xyz/gemthread/threads/<THREAD_ID>/respond?<URL_ENCODED_URL>
 	if pathcomps[2] == "respond" {
@@ -284,29 +463,40 @@ func handle_threads(fd io.ReadWriteCloser, db *sql.DB, pathcomps []string, query
 			return
 		}
 
-		result, err := retrieve(tgt_url)
+		if !strings.HasPrefix(tgt_url, "gemini://") {
+			write_response(fd, 50, "only gemini:// URLs may be added to a GemThreads server")
+			return
+		}
+
+		if is_blocked_url(tgt_url) {
+			write_response(fd, 50, "pages from this host may not be added to this GemThreads server")
+			return
+		}
+
+		err = reserve_submission(client, submission_response)
 		if err != nil {
-			write_response(fd, 50, "unable to retrieve "+tgt_url+": "+err.Error())
+			write_submission_error(fd, tgt_url, err)
+			return
 		}
 
-		msg, is_allowed, err := parse_post(tgt_url, result)
+		thr, err := db_find_thread_by_id(db, int64(thr_id))
 		if err != nil {
-			write_response(fd, 50, "unable to parse "+tgt_url+" contents: "+err.Error())
+			write_response(fd, 50, "error while retrieving thread: "+err.Error())
 			return
 		}
 
-		if !is_allowed {
-			write_response(fd, 50, "PROHIBITED: the requested page contains \"GemThread.Prohibit\"")
+		if thr.id == 0 {
+			write_response(fd, 51, fmt.Sprintf("thread %d not found", thr_id))
 			return
 		}
 
-		msg.id, err = db_insert_response_message(db, int64(thr_id), msg)
+		sub_id, err := queue_submission(db, submission_response, tgt_url, int64(thr_id))
 		if err != nil {
-			write_response(fd, 50, "unable to insert message: "+err.Error())
+			write_response(fd, 50, "unable to queue submission: "+err.Error())
 			return
 		}
 
-		write_response(fd, 30, fmt.Sprintf("%s/threads/%d", server_url(), thr_id))
+		write_response(fd, 30, fmt.Sprintf("%s/submissions/%d", server_url(), sub_id))
 
 		return
 	}
@@ -315,10 +505,100 @@ func handle_threads(fd io.ReadWriteCloser, db *sql.DB, pathcomps []string, query
 	return
 }
 
+// Handle requests of the form:
+// => gemini://hostname.xyz/gemthread/submissions/<SUBMISSION_ID>
+func handle_submissions(fd io.ReadWriteCloser, db *sql.DB, pathcomps []string) {
+
+	if len(pathcomps) != 2 {
+		write_response(fd, 51, "not found")
+		return
+	}
+
+	sub_id, err := strconv.Atoi(pathcomps[1])
+	if err != nil {
+		write_response(fd, 59, "invalid or malformed submission ID "+pathcomps[1])
+		return
+	}
+
+	sub, err := db_find_submission_by_id(db, int64(sub_id))
+	if err != nil {
+		write_response(fd, 50, "error while retrieving submission: "+err.Error())
+		return
+	}
+
+	if sub.id == 0 {
+		write_response(fd, 51, fmt.Sprintf("submission %d not found", sub_id))
+		return
+	}
+
+	if sub.kind == submission_auto_response {
+		sub.threads, err = db_find_submission_threads(db, sub.id)
+		if err != nil {
+			write_response(fd, 50, "error while retrieving submission: "+err.Error())
+			return
+		}
+	}
+
+	// A response added to more than one thread is shown with a list of them
+	if sub.status == submission_done && len(sub.threads) < 2 {
+		write_response(fd, 30, fmt.Sprintf("%s/threads/%d", server_url(), sub.result_threads_id))
+		return
+	}
+
+	write_response(fd, 20, sub.String())
+}
+
+// Handle requests of the form:
+// => gemini://hostname.xyz/gemthread/respond?<URL_ENCODED_URL>
+func handle_respond(fd io.ReadWriteCloser, db *sql.DB, client string, pathcomps []string, query_string string) {
+
+	if len(pathcomps) != 1 {
+		write_response(fd, 51, "not found")
+		return
+	}
+
+	if query_string == "" {
+		write_response(fd, 10, "Please enter the URL for the response message; it will be added to the threads that it links to")
+		return
+	}
+
+	tgt_url, err := url.QueryUnescape(query_string)
+	if err != nil || tgt_url == "" {
+		write_response(fd, 59, "unable to unescape query string "+query_string)
+		return
+	}
+
+	if !strings.HasPrefix(tgt_url, "gemini://") {
+		write_response(fd, 50, "only gemini:// URLs may be added to a GemThreads server")
+		return
+	}
+
+	if is_blocked_url(tgt_url) {
+		write_response(fd, 50, "pages from this host may not be added to this GemThreads server")
+		return
+	}
+
+	err = reserve_submission(client, submission_response)
+	if err != nil {
+		write_submission_error(fd, tgt_url, err)
+		return
+	}
+
+	sub_id, err := queue_submission(db, submission_auto_response, tgt_url, 0)
+	if err != nil {
+		write_response(fd, 50, "unable to queue submission: "+err.Error())
+		return
+	}
+
+	write_response(fd, 30, fmt.Sprintf("%s/submissions/%d", server_url(), sub_id))
+}
+
 // Handle requests of the form:
 // => gemini://hostname.xyz/gemthread/messages/<MESSAGE_ID>
 // => gemini://hostname.xyz/gemthread/messages/<MESSAGE_ID>/update
-func handle_messages(fd io.ReadWriteCloser, db *sql.DB, pathcomps []string, query_string string) {
+// => gemini://hostname.xyz/gemthread/messages/<MESSAGE_ID>/archive
+// => gemini://hostname.xyz/gemthread/messages/<MESSAGE_ID>/history
+func handle_messages(ctx context.Context, fd io.ReadWriteCloser, db *sql.DB, client string, pathcomps []string, query_string string) {
 
 	if len(pathcomps) == 1 {
 		// URL is gemini://hostname.xyz/gemthread/messages
@@ -411,7 +691,53 @@ func handle_messages(fd io.ReadWriteCloser, db *sql.DB, pathcomps []string, quer
 		return
 	}
 
-	if len(pathcomps) == 3 {
+	if len(pathcomps) == 3 && pathcomps[2] == "archive" {
+		// => gemini://twistedcarrot.com/gemthread/messages/<MESSAGE_ID>/archive
+		msg, err := db_find_message_by_id(db, int64(msg_id))
+		if err != nil {
+			write_response(fd, 51, fmt.Sprintf("error when attempting to find message with ID %d: %s", msg_id, err.Error()))
+			return
+		}
+
+		snap, err := db_find_snapshot(db, int64(msg_id))
+		if err != nil {
+			write_response(fd, 50, "error when attempting to find archived copy: "+err.Error())
+			return
+		}
+
+		if msg.id == 0 || snap.messages_id == 0 {
+			write_response(fd, 51, fmt.Sprintf("no archived copy of message %d is available", msg_id))
+			return
+		}
+
+		write_response(fd, 20, snap.GemtextString(msg))
+		return
+	}
+
+	if len(pathcomps) == 3 && pathcomps[2] == "history" {
+		// => gemini://twistedcarrot.com/gemthread/messages/<MESSAGE_ID>/history
+		msg, err := db_find_message_by_id(db, int64(msg_id))
+		if err != nil {
+			write_response(fd, 51, fmt.Sprintf("error when attempting to find message with ID %d: %s", msg_id, err.Error()))
+			return
+		}
+
+		if msg.id == 0 {
+			write_response(fd, 51, fmt.Sprintf("message %d not found", msg_id))
+			return
+		}
+
+		rstr, err := history_string(db, msg)
+		if err != nil {
+			write_response(fd, 50, "error when attempting to find message history: "+err.Error())
+			return
+		}
+
+		write_response(fd, 20, rstr)
+		return
+	}
+
+	if len(pathcomps) == 3 && pathcomps[2] == "update" {
 		// => gemini://twistedcarrot.com/gemthread/messages/<MESSAGE_ID>/update?<URL_ENCODED_URL>
 
 		if query_string == "" {
@@ -441,36 +767,29 @@ func handle_messages(fd io.ReadWriteCloser, db *sql.DB, pathcomps []string, quer
 			return
 		}
 
-		result, err := retrieve(tgt_url)
+		err = reserve_submission(client, submission_refetch)
 		if err != nil {
-			write_response(fd, 50, "unable to retrieve "+tgt_url+": "+err.Error())
+			write_submission_error(fd, tgt_url, err)
 			return
 		}
 
-		retrieved_msg, is_allowed, err := parse_post(tgt_url, result)
+		saved_msg, outcome, err := refresh_message(ctx, db, saved_msg, false)
 		if err != nil {
-			write_response(fd, 50, "unable to parse "+tgt_url+" contents: "+err.Error())
+			if outcome == check_failed {
+				write_submission_error(fd, tgt_url, err)
+			} else {
+				write_response(fd, 50, err.Error())
+			}
 			return
 		}
 
-		if !is_allowed {
-
-			_, err = db_delete_message(db, saved_msg)
-			if err != nil {
-				write_response(fd, 50, "unable to delete message: "+err.Error())
-				return
-			}
-
+		if outcome == check_removed {
 			write_response(fd, 20, fmt.Sprintf("Removed message with ID %d from database in response to \"GemThread.Prohibit\" line.", saved_msg.id))
 			return
 		}
 
-		saved_msg.author = retrieved_msg.author
-		saved_msg.title = retrieved_msg.title
-		saved_msg.summary = retrieved_msg.summary
-		_, err = db_update_message(db, saved_msg, nil)
-		if err != nil {
-			write_response(fd, 50, "unable to update message: "+err.Error())
+		if outcome == check_gone {
+			write_response(fd, 20, fmt.Sprintf("Removed message with ID %d from database because the remote server replied that the page is gone.", saved_msg.id))
 			return
 		}
 
@@ -486,7 +805,41 @@ func handle_messages(fd io.ReadWriteCloser, db *sql.DB, pathcomps []string, quer
 
 // Handle requests of the form:
 // => gemini://twistedcarrot.com/gemthread/search?<URL_ENCODED_URL_PATH>
-func handle_search(fd io.ReadWriteCloser, db *sql.DB, pathcomps []string, query_string string) {
+// => gemini://twistedcarrot.com/gemthread/search/text?<URL_ENCODED_SEARCH_TERMS>
+func handle_search(ctx context.Context, fd io.ReadWriteCloser, db *sql.DB, pathcomps []string, query_string string) {
+
+	if len(pathcomps) == 2 && pathcomps[1] == "text" {
+
+		if !_fts5_available {
+			write_response(fd, 50, "full-text search is not available on this server: it was built without SQLite's FTS5 extension")
+			return
+		}
+
+		if query_string == "" {
+			write_response(fd, 10, "Search titles, authors, summaries and archived pages. Use \"quotes\" for a phrase, or end a word with * to match the start of words")
+			return
+		}
+
+		query, err := url.QueryUnescape(query_string)
+		if err != nil || strings.TrimSpace(query) == "" {
+			write_response(fd, 59, "unable to unescape query string "+query_string)
+			return
+		}
+
+		results, err := search_messages(db, query)
+		if err != nil {
+			write_response(fd, 50, "error during search: "+err.Error())
+			return
+		}
+
+		write_response(fd, 20, results)
+		return
+	}
+
+	if len(pathcomps) > 1 {
+		write_response(fd, 51, "not found")
+		return
+	}
 
 	if query_string == "" {
 		write_response(fd, 10, "Please enter the URL or partial URL for which to search")
@@ -516,29 +869,13 @@ func handle_search(fd io.ReadWriteCloser, db *sql.DB, pathcomps []string, query_
 	return
 }
 
-func handle_request(fd io.ReadWriteCloser, db *sql.DB) {
-
-	defer fd.Close()
-
-	request_bytes, err := read_request_bytes(fd)
-
-	if err != nil {
-		write_response(fd, 59, err.Error())
-		return
-	}
-
-	scgi_headers, query_string, err := unpack_request_bytes(request_bytes)
-
-	if err != nil {
-		write_response(fd, 59, err.Error())
-		return
-	}
+func route_request(ctx context.Context, fd io.ReadWriteCloser, db *sql.DB, req gemthread_request) {
 
-	path := scgi_headers["PATH_INFO"]
+	query_string := req.query_string
 
 	var pathcomps []string
 
-	for _, s := range strings.Split(path, "/")[1:] {
+	for _, s := range strings.Split(req.path_info, "/") {
 		if len(s) > 0 {
 			pathcomps = append(pathcomps, s)
 		}
@@ -548,13 +885,19 @@ func handle_request(fd io.ReadWriteCloser, db *sql.DB) {
 		handle_help(fd)
 		return
 	} else if pathcomps[0] == "threads" {
-		handle_threads(fd, db, pathcomps, query_string)
+		handle_threads(ctx, fd, db, client_id(req), pathcomps, query_string)
 		return
 	} else if pathcomps[0] == "messages" {
-		handle_messages(fd, db, pathcomps, query_string)
+		handle_messages(ctx, fd, db, client_id(req), pathcomps, query_string)
+		return
+	} else if pathcomps[0] == "respond" {
+		handle_respond(fd, db, client_id(req), pathcomps, query_string)
+		return
+	} else if pathcomps[0] == "submissions" {
+		handle_submissions(fd, db, pathcomps)
 		return
 	} else if pathcomps[0] == "search" {
-		handle_search(fd, db, pathcomps, query_string)
+		handle_search(ctx, fd, db, pathcomps, query_string)
 		return
 	} else {
 		write_response(fd, 51, "not found")
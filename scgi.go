@@ -123,3 +123,8 @@ func write_response(fd io.ReadWriteCloser,
 	}
 	return fd.Write(buf.Bytes())
 }
+
+// Writes a successful response whose body is not gemtext.
+func write_document(fd io.ReadWriteCloser, media_type string, body string) (n int, err error) {
+	return fmt.Fprintf(fd, "20 %s\r\n%s", media_type, body)
+}
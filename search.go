@@ -0,0 +1,108 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// Full-text search over the title, author and summary of each message, and the text
+// of its snapshot when there is one. The index is an FTS5 table, message_search, that
+// triggers keep in step with the messages and snapshots tables. FTS5 is only built
+// into SQLite when gemthread is built with "-tags sqlite_fts5", as the Makefile does;
+// without it, searches are refused.
+
+// Whether the database has a full-text search index, as found by db_create_search_index
+var _fts5_available bool
+
+// The number of results shown for a search
+const search_result_limit = 50
+
+// Marks the matching text in a snippet
+const search_highlight = "**"
+
+type search_hit struct {
+	msg     GemThreadMessage
+	snippet string
+}
+
+// Splits a search into its terms. Text in double quotes is a phrase, and a term that
+// ends with "*" matches any word that starts with it.
+func parse_search_terms(query string) []string {
+
+	var terms []string
+
+	for i, part := range strings.Split(query, "\"") {
+		// Parts at odd positions were inside quotes
+		if i%2 == 1 {
+			if phrase := strings.TrimSpace(part); len(phrase) > 0 {
+				terms = append(terms, "\""+phrase+"\"")
+			}
+			continue
+		}
+		terms = append(terms, strings.Fields(part)...)
+	}
+
+	return terms
+}
+
+// Builds an FTS5 query that matches messages that contain all of terms. Each term is
+// quoted, so that nothing in it is taken as FTS5 query syntax.
+func fts5_query(terms []string) string {
+
+	var quoted []string
+
+	for _, term := range terms {
+		is_prefix := strings.HasSuffix(term, "*")
+		term = strings.TrimSuffix(term, "*")
+		term = strings.Trim(term, "\"")
+		if len(term) == 0 {
+			continue
+		}
+		q := "\"" + strings.ReplaceAll(term, "\"", "\"\"") + "\""
+		if is_prefix {
+			q += "*"
+		}
+		quoted = append(quoted, q)
+	}
+
+	return strings.Join(quoted, " ")
+}
+
+// Searches the messages for query, and returns the results page.
+func search_messages(db *sql.DB, query string) (string, error) {
+
+	terms := parse_search_terms(query)
+
+	var hits []search_hit
+	var err error
+
+	fts_query := fts5_query(terms)
+	if len(fts_query) > 0 {
+		hits, err = db_search_messages(db, fts_query, search_result_limit)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// A line break in the query would start a new line of gemtext
+	heading := strings.NewReplacer("\r", " ", "\n", " ").Replace(query)
+	rstr := "# Search results for " + heading + "\r\n\r\n"
+
+	if len(hits) == 0 {
+		rstr += "No messages matched.\r\n"
+	} else if len(hits) == search_result_limit {
+		rstr += fmt.Sprintf("Showing the first %d matches.\r\n\r\n", search_result_limit)
+	}
+
+	for _, hit := range hits {
+		if snippet := strings.Join(strings.Fields(hit.snippet), " "); len(snippet) > 0 {
+			rstr += "> " + snippet + "\r\n"
+		}
+		rstr += hit.msg.InstancesString(db)
+	}
+
+	rstr += fmt.Sprintf("=> %s/search/text Search again\r\n", server_url())
+
+	return rstr, nil
+}
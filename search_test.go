@@ -0,0 +1,99 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFts5Query(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		query string
+		terms []string
+		want  string
+	}{
+		{"words", "gemini capsule", []string{"gemini", "capsule"}, `"gemini" "capsule"`},
+		{"extra spaces", "  gemini \t capsule ", []string{"gemini", "capsule"}, `"gemini" "capsule"`},
+		{"a phrase", `"small web" gemini`, []string{`"small web"`, "gemini"}, `"small web" "gemini"`},
+		{"an empty phrase", `"" gemini`, []string{"gemini"}, `"gemini"`},
+		{"an unbalanced quote", `gemini "small web`, []string{"gemini", `"small web"`}, `"gemini" "small web"`},
+		{"a quote inside a word", `gem"ini`, []string{"gem", `"ini"`}, `"gem" "ini"`},
+		{"a prefix", "capsu*", []string{"capsu*"}, `"capsu"*`},
+		{"a lone star", "*", []string{"*"}, ""},
+		{"NEAR", "NEAR(gemini capsule, 5)", []string{"NEAR(gemini", "capsule,", "5)"}, `"NEAR(gemini" "capsule," "5)"`},
+		{"operators", "gemini OR NOT capsule AND -web", []string{"gemini", "OR", "NOT", "capsule", "AND", "-web"}, `"gemini" "OR" "NOT" "capsule" "AND" "-web"`},
+		{"a column filter", "title:gemini", []string{"title:gemini"}, `"title:gemini"`},
+		{"a column set filter", "{title author}:gemini", []string{"{title", "author}:gemini"}, `"{title" "author}:gemini"`},
+		{"an initial token", "^gemini", []string{"^gemini"}, `"^gemini"`},
+		{"a plus", "gemini + capsule", []string{"gemini", "+", "capsule"}, `"gemini" "+" "capsule"`},
+		{"nothing", "   ", nil, ""},
+	}
+
+	for _, test := range tests {
+		terms := parse_search_terms(test.query)
+		if !reflect.DeepEqual(terms, test.terms) {
+			t.Errorf("%s: parse_search_terms(%q): got %q, want %q", test.name, test.query, terms, test.terms)
+		}
+		got := fts5_query(terms)
+		if got != test.want {
+			t.Errorf("%s: fts5_query(%q): got %q, want %q", test.name, terms, got, test.want)
+		}
+	}
+}
+
+// Runs queries that would be FTS5 syntax errors if they were not quoted. Needs a build
+// with FTS5, such as "go test -tags sqlite_fts5".
+func TestSearchMessages(t *testing.T) {
+
+	cfg := default_config()
+	cfg.ServerURL = "gemini://gemthread.example/gemthread"
+	set_config(cfg, nil)
+
+	db, err := db_open(filepath.Join(t.TempDir(), "gemthread.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if !_fts5_available {
+		t.Skip("SQLite was built without FTS5")
+	}
+
+	_, err = db_create_new_thread(db, GemThreadMessage{url: "gemini://a.example/post.gmi", author: "alice", title: "Capsule near the small web", summary: "title: gemini"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query string
+		hits  int
+	}{
+		{"capsule", 1},
+		{"capsu*", 1},
+		{`"small web"`, 1},
+		{`"web small"`, 0},
+		{`"small web`, 1},
+		{"NEAR(capsule small)", 0},
+		{"near small", 1},
+		{"title:capsule", 0},
+		{"title:gemini", 1},
+		{"^capsule", 1},
+		{"capsule OR nothing", 0},
+		{"-capsule", 1},
+		{`capsule"`, 1},
+		{"(", 0},
+	}
+
+	for _, test := range tests {
+		hits, err := db_search_messages(db, fts5_query(parse_search_terms(test.query)), search_result_limit)
+		if err != nil {
+			t.Errorf("%q: %s", test.query, err.Error())
+			continue
+		}
+		if len(hits) != test.hits {
+			t.Errorf("%q: got %d hits, want %d", test.query, len(hits), test.hits)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// When snapshots are enabled, the body of every page that is added or refreshed is
+// kept in the snapshots table, so that an archived copy can still be shown once the
+// page itself has become unreachable. Only the last good copy of each page is kept,
+// and it is deleted along with its message, including when the page's author adds
+// "GemThread.Prohibit" to it.
+
+type GemThreadSnapshot struct {
+	messages_id  int64
+	body         string
+	content_hash string
+	media_type   string
+	dt_fetched   string
+}
+
+// Keeps a copy of the page fetched for a message, if snapshots are enabled.
+func save_snapshot(db *sql.DB, msg_id int64, page fetched_page) error {
+
+	if !config().Snapshots.Enabled {
+		return nil
+	}
+
+	return db_save_snapshot(db, GemThreadSnapshot{
+		messages_id:  msg_id,
+		body:         page.body,
+		content_hash: content_hash(page.body),
+		media_type:   page.media_type,
+		dt_fetched:   now_timestamp(),
+	})
+}
+
+// Returns the snapshot as gemtext, headed by a banner that says that it is an
+// archived copy. Pages that are not gemtext are shown as preformatted text.
+func (snap GemThreadSnapshot) GemtextString(msg GemThreadMessage) string {
+
+	rstr := fmt.Sprintf("> This is an archived copy of a page, kept by this GemThread server when it last fetched the page on %s. The page itself may have changed or disappeared since then.\r\n", snap.dt_fetched)
+	rstr += "=> " + msg.url + " The page itself\r\n"
+	rstr += fmt.Sprintf("=> %s/messages/%d About this message\r\n", server_url(), msg.id)
+	rstr += "\r\n"
+
+	if snap.media_type == "text/gemini" {
+		return rstr + snap.body
+	}
+
+	rstr += "```" + snap.media_type + "\r\n"
+	for _, line := range strings.Split(strings.TrimRight(snap.body, "\n"), "\n") {
+		// A line that starts with ``` would end the preformatted text early
+		if strings.HasPrefix(line, "```") {
+			line = " " + line
+		}
+		rstr += strings.TrimRight(line, "\r") + "\r\n"
+	}
+	rstr += "```\r\n"
+
+	return rstr
+}
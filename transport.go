@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// A gemthread_request holds the parts of an incoming request that the route handlers
+// need, independent of the transport that delivered it.
+type gemthread_request struct {
+	path_info    string
+	query_string string
+	// CGI-style meta-variables (REMOTE_ADDR, TLS_CLIENT_HASH and so on), when the
+	// transport provides them.
+	params map[string]string
+}
+
+// Builds a request from CGI meta-variables. SCGI headers, FastCGI params, and the CGI
+// environment all use the same names.
+func request_from_params(params map[string]string) gemthread_request {
+	return gemthread_request{
+		path_info:    params["PATH_INFO"],
+		query_string: params["QUERY_STRING"],
+		params:       params,
+	}
+}
+
+// A transport accepts connections on a listener and serves every request that
+// arrives on each connection.
+type transport struct {
+	listen     func() (net.Listener, error)
+	serve_conn func(ctx context.Context, fd net.Conn, db *sql.DB)
+	// Whether the transport listens on the UNIX socket at socket_path
+	uses_socket bool
+}
+
+var transports = map[string]transport{
+	"scgi":    {listen_scgi, handle_scgi_request, true},
+	"fastcgi": {listen_fastcgi, handle_fastcgi_request, true},
+	"gemini":  {listen_gemini, handle_gemini_request, false},
+}
+
+func listen_unix_socket() (net.Listener, error) {
+
+	if len(socket_path()) == 0 {
+		return nil, errors.New("invalid socket path: " + socket_path())
+	}
+
+	err := remove_stale_socket(socket_path())
+	if err != nil {
+		return nil, err
+	}
+
+	return net.Listen("unix", socket_path())
+}
+
+func listen_scgi() (net.Listener, error) {
+	// Molly Brown only supports UNIX sockets
+	return listen_unix_socket()
+}
+
+func listen_fastcgi() (net.Listener, error) {
+	return listen_unix_socket()
+}
+
+// Removes a socket file left behind by a gemthread process that did not shut down
+// cleanly. The file is only removed if it is a socket and nothing is listening on it.
+func remove_stale_socket(path string) error {
+
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if info.Mode()&os.ModeSocket == 0 {
+		return errors.New(path + " exists and is not a socket")
+	}
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return errors.New("another process is already listening on " + path)
+	}
+
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return errors.New("unable to determine whether " + path + " is in use: " + err.Error())
+	}
+
+	fmt.Println("Removing stale socket", path)
+
+	return os.Remove(path)
+}
+
+// Removes the transport's socket file, if it has one, once the listener is closed.
+func remove_socket(t transport) {
+
+	if !t.uses_socket {
+		return
+	}
+
+	err := os.Remove(socket_path())
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Printf("Error removing socket %s: %s\n", socket_path(), err.Error())
+	}
+}
+
+func handle_scgi_request(ctx context.Context, fd net.Conn, db *sql.DB) {
+
+	defer fd.Close()
+
+	request_bytes, err := read_request_bytes(fd)
+
+	if err != nil {
+		write_response(fd, 59, err.Error())
+		return
+	}
+
+	scgi_headers, _, err := unpack_request_bytes(request_bytes)
+
+	if err != nil {
+		write_response(fd, 59, err.Error())
+		return
+	}
+
+	ctx, cancel := watch_for_disconnect(ctx, fd)
+	defer cancel()
+
+	route_request(ctx, fd, db, request_from_params(scgi_headers))
+}
+
+func handle_gemini_request(ctx context.Context, fd net.Conn, db *sql.DB) {
+
+	defer fd.Close()
+
+	req, err := read_gemini_request(fd)
+
+	if err != nil {
+		write_response(fd, 59, err.Error())
+		return
+	}
+
+	ctx, cancel := watch_for_disconnect(ctx, fd)
+	defer cancel()
+
+	route_request(ctx, fd, db, req)
+}
+
+func handle_fastcgi_request(ctx context.Context, fd net.Conn, db *sql.DB) {
+
+	defer fd.Close()
+
+	reader := bufio.NewReader(fd)
+
+	for {
+		request_id, keep_conn, params, err := read_fastcgi_request(reader, fd)
+
+		if err != nil {
+			if !is_closed_conn_error(err) {
+				fmt.Println("FastCGI request error", err.Error())
+			}
+			return
+		}
+
+		stdout := &fastcgi_writer{fd: fd, request_id: request_id}
+		route_request(ctx, stdout, db, request_from_params(params))
+
+		err = stdout.Close()
+		if err != nil {
+			fmt.Println("FastCGI response error", err.Error())
+			return
+		}
+
+		if !keep_conn {
+			return
+		}
+	}
+}
+
+// Returns a context that is cancelled when the connection to the client fails, so that
+// work done on its behalf, such as fetching a page, can be abandoned. The client has
+// nothing more to send once its request has been read, so data from it is treated as
+// a failure too. A client that only closes its sending side is still waiting for the
+// response, so the end of its data is not.
+func watch_for_disconnect(ctx context.Context, fd net.Conn) (context.Context, context.CancelFunc) {
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	go func() {
+		var buf [1]byte
+		n, err := fd.Read(buf[:])
+		if n > 0 || (err != nil && !errors.Is(err, io.EOF)) {
+			cancel()
+		}
+	}()
+
+	return ctx, cancel
+}
+
+// Serves a single request from the CGI environment, writing the response to
+// response, which is the standard output that the Gemini server reads.
+func handle_cgi_request(ctx context.Context, db *sql.DB, response *os.File) {
+
+	params := make(map[string]string)
+
+	for _, kv := range os.Environ() {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) == 2 {
+			params[parts[0]] = parts[1]
+		}
+	}
+
+	route_request(ctx, response, db, request_from_params(params))
+}
+
+// Reports whether the CGI environment is present, i.e. gemthread was started by a
+// Gemini server to handle a single request.
+func is_cgi_environment() bool {
+	return len(os.Getenv("GATEWAY_INTERFACE")) > 0
+}